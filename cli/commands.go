@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	"github.com/frapposelli/nocino/pkg/markov"
+)
+
+// runCommand runs an offline maintenance command against the state file.
+// The bot must not be running, as it holds a lock on the state file.
+func runCommand(name string, args []string) {
+	switch name {
+	case "compact":
+		compactState()
+	case "fsck":
+		checkState(args)
+	case "stats":
+		printStats()
+	case "migrate":
+		migrateState()
+	default:
+		log.Fatalf("Unknown command '%s', available commands: compact, fsck, migrate, stats", name)
+	}
+}
+
+func compactState() {
+	mchain = markov.NewChain(plen, nil, log)
+	mchain.ReadState(state)
+	defer mchain.Close()
+
+	before, after, err := mchain.Compact()
+	if err != nil {
+		log.Fatalf("Compaction of '%s' failed with: '%s'", state, err)
+	}
+	log.Infof("Compacted '%s' from %d bytes to %d bytes", state, before, after)
+}
+
+func migrateState() {
+	mchain = markov.NewChain(plen, nil, log)
+	if err := mchain.Migrate(state, backupdir); err != nil {
+		log.Fatalf("Migration of '%s' failed with: '%s'", state, err)
+	}
+	log.Infof("State file '%s' uses the current schema", state)
+}
+
+func checkState(args []string) {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := fs.Bool("repair", false, "repair or drop bad entries")
+	fs.Parse(args)
+
+	mchain = markov.NewChain(plen, nil, log)
+	mchain.ReadState(state)
+	defer mchain.Close()
+
+	problems, err := mchain.Check(*repair)
+	if err != nil {
+		log.Fatalf("Check of '%s' failed with: '%s'", state, err)
+	}
+
+	var unrepaired int
+	for _, p := range problems {
+		log.Warnln(p)
+		if !p.Repaired {
+			unrepaired++
+		}
+	}
+	log.Infof("Checked '%s': %d problems found, %d left unrepaired", state, len(problems), unrepaired)
+	if unrepaired > 0 {
+		mchain.Close()
+		os.Exit(1)
+	}
+}
+
+func printStats() {
+	mchain = markov.NewChain(plen, nil, log)
+	mchain.ReadState(state)
+	defer mchain.Close()
+
+	st, err := mchain.Stats()
+	if err != nil {
+		log.Fatalf("Cannot get stats of '%s': '%s'", state, err)
+	}
+	log.Infof("Prefixes: %d", st.Prefixes)
+	log.Infof("Transitions: %d", st.Transitions)
+	log.Infof("Branching: %.2f avg, %d max", st.AvgBranching, st.MaxBranching)
+	log.Infof("Vocabulary: %d words", st.Vocabulary)
+	for i, w := range st.TopWords {
+		log.Infof("Top word #%d: %s (%d)", i+1, w.Word, w.Count)
+	}
+	for id, n := range st.Chats {
+		log.Infof("Chat %d: %d words learned", id, n)
+	}
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"flag"
 	"fmt"
-	"math/rand"
 	"os"
 	"path"
 	"path/filepath"
@@ -31,8 +30,41 @@ var (
 	gifstore   string
 	gifmaxsize int
 	checkpoint time.Duration
+	corpusage  time.Duration
+	weighted   bool
+	backupdir  string
+	backupkeep int
+	backupgzip bool
+	compactat  string
+	botstate   string
+	interject  float64
+	cooldown   time.Duration
+	minmsgs    int
+	minusers   int
+	gifratio   float64
+	stickratio float64
+	bothratio  float64
+	learn      bool
+	skipbots   bool
+	skipfwd    bool
+	skipcmds   bool
+	learnmin   int
+	learnmax   int
+	maxmarkup  float64
+	filters    string
+	aliases    string
+	goodwords  string
+	badwords   string
+	quiethours string
+	language   string
+	chatrate   float64
+	chatburst  int
+	userrate   float64
+	userburst  int
+	calmdown   bool
 	mchain     *markov.Chain
 	gifdb      *gif.GIFDB
+	seed       int64
 	debug      bool
 	version    = "dev"
 	date       = "unknown"
@@ -51,8 +83,6 @@ const banner = `  [~]
 var log = logrus.New()
 
 func init() {
-	rand.Seed(time.Now().UTC().UnixNano())
-
 	log.Formatter = &prefixed.TextFormatter{
 		FullTimestamp:   true,
 		TimestampFormat: "2006-01-02T15:04:05",
@@ -70,7 +100,40 @@ func init() {
 	flag.StringVar(&gifstore, "gifstore", fmt.Sprintf("%s/gifs", filepath.Dir(exe)), "path to store GIFs")
 	flag.IntVar(&gifmaxsize, "gifmax", 1048576, "max GIF size in bytes")
 	flag.StringVar(&trustedIDs, "trustedids", "", "trusted ids separated by comma")
-	flag.DurationVar(&checkpoint, "checkpoint", 60*time.Second, "checkpoint interval for state file in seconds")
+	flag.DurationVar(&checkpoint, "checkpoint", 1*time.Hour, "interval between backups of the state file, 0 disables them")
+	flag.DurationVar(&corpusage, "corpusage", 30*24*time.Hour, "how long learned messages are kept to be relearned when edited, forever if 0")
+	flag.StringVar(&backupdir, "backupdir", fmt.Sprintf("%s/backups", filepath.Dir(exe)), "path to store state file backups")
+	flag.IntVar(&backupkeep, "backupkeep", 24, "number of state file backups to keep")
+	flag.BoolVar(&backupgzip, "backupgzip", true, "gzip state file backups")
+	flag.StringVar(&compactat, "compactat", "", "daily time (HH:MM) to compact the state file at, disabled if empty")
+	flag.StringVar(&botstate, "botstate", fmt.Sprintf("%s/nocino.bot.db", filepath.Dir(exe)), "state file for per-chat configuration")
+	flag.Float64Var(&interject, "interject", 0, "probability of replying unprompted to group messages, 0 disables it")
+	flag.DurationVar(&cooldown, "interjectcooldown", 30*time.Minute, "minimum time between unprompted replies in a chat")
+	flag.IntVar(&minmsgs, "interjectmsgs", 5, "messages needed in the last 10 minutes to reply unprompted")
+	flag.IntVar(&minusers, "interjectusers", 2, "people talking in the last 10 minutes needed to reply unprompted")
+	flag.Float64Var(&gifratio, "gifratio", 0.5, "share of replies that are GIFs")
+	flag.Float64Var(&stickratio, "stickerratio", 0, "share of replies that are stickers")
+	flag.Float64Var(&bothratio, "bothratio", 0, "share of replies that are a GIF followed by text")
+	flag.BoolVar(&learn, "learn", true, "learn from messages")
+	flag.BoolVar(&weighted, "weighted", false, "pick continuations proportionally to how often they were learned and to feedback, instead of uniformly, votes on replies are only taken if set")
+	flag.BoolVar(&skipbots, "skipbots", true, "do not learn messages sent by bots")
+	flag.BoolVar(&skipfwd, "skipforwards", true, "do not learn forwarded messages")
+	flag.BoolVar(&skipcmds, "skipcommands", true, "do not learn commands")
+	flag.IntVar(&learnmin, "learnmin", 0, "minimum length of learned messages in characters, disabled if 0")
+	flag.IntVar(&learnmax, "learnmax", 1000, "maximum length of learned messages in characters, disabled if 0")
+	flag.Float64Var(&maxmarkup, "maxmarkup", 0.5, "largest share of a learned message that can be URLs or code, disabled if 0")
+	flag.StringVar(&language, "language", "", "language spoken in chats, as an ISO 639-1 code")
+	flag.StringVar(&filters, "filters", "", "regular expressions separated by comma, matching messages are not learned nor sent")
+	flag.StringVar(&aliases, "aliases", "nocino,noci", "names separated by comma that summon the bot like a mention")
+	flag.StringVar(&goodwords, "feedbackup", "👍,lol,haha,lmao", "words separated by comma that upvote the bot message they reply to")
+	flag.StringVar(&badwords, "feedbackdown", "👎,boring,meh", "words separated by comma that downvote the bot message they reply to")
+	flag.StringVar(&quiethours, "quiethours", "", "daily time range (HH:MM-HH:MM) during which the bot does not talk, disabled if empty")
+	flag.Float64Var(&chatrate, "chatrate", 20, "replies per minute allowed in a chat, unlimited if 0")
+	flag.IntVar(&chatburst, "chatburst", 10, "replies allowed in a burst in a chat")
+	flag.Float64Var(&userrate, "userrate", 4, "replies per minute allowed to each user, unlimited if 0")
+	flag.IntVar(&userburst, "userburst", 3, "replies allowed in a burst to each user")
+	flag.BoolVar(&calmdown, "calmdown", true, "tell users when they are rate limited instead of ignoring them")
+	flag.Int64Var(&seed, "seed", 0, "seed for the random number generator, random if 0")
 	flag.BoolVar(&debug, "debug", false, "print debug")
 
 }
@@ -99,19 +162,106 @@ func main() {
 		}
 	}
 
+	// Run maintenance commands instead of the bot
+	if flag.NArg() > 0 {
+		runCommand(flag.Arg(0), flag.Args()[1:])
+		return
+	}
+
+	// Initialize random source, shared by the chain and the handlers
+	if seed == 0 {
+		seed = time.Now().UTC().UnixNano()
+	}
+	src := markov.NewSource(seed)
+
 	// Initialize Markov Chain
-	mchain = markov.NewChain(plen, log)
+	mchain = markov.NewChain(plen, src, log)
 	mchain.ReadState(state)
-	defer mchain.DB.Close()
-	// state file save ticker
-	// mchain.RunStateSaveTicker(checkpoint, state)
+	defer mchain.Close()
+	mchain.SetWeighted(weighted)
+	// state file backup ticker
+	mchain.RunBackupTicker(checkpoint, backupdir, backupkeep, backupgzip)
+	// forget old messages so the corpus does not grow forever
+	mchain.RunCorpusPruner(corpusage)
+	// state file compaction in the maintenance window
+	if compactat != "" {
+		at, err := time.Parse("15:04", compactat)
+		if err != nil {
+			log.Fatalf("Invalid compaction time '%s', expected HH:MM", compactat)
+		}
+		mchain.RunCompactScheduler(at)
+	}
 
 	// Initialize GIF store and DB
 	gifdb = gif.NewGIFDB(gifstore, log)
 	gifdb.ReadList()
 
-	n := nocino.NewNocino(tgtoken, trustedIDs, numw, plen, gifmaxsize, log)
-	n.RunStatsTicker(mchain.DB, gifdb)
+	// Initialize per-chat configuration store
+	store, err := nocino.OpenStore(botstate, log)
+	if err != nil {
+		log.Fatalf("Cannot open bot state file '%s': '%s'", botstate, err)
+	}
+	defer store.Close()
+
+	quiet, err := nocino.ParseQuietHours(quiethours)
+	if err != nil {
+		log.Fatalf("Invalid quiet hours: '%s'", err)
+	}
+	var contentFilters []string
+	if filters != "" {
+		contentFilters = strings.Split(filters, ",")
+	}
+	var nameAliases []string
+	if aliases != "" {
+		nameAliases = strings.Split(aliases, ",")
+	}
+	var feedbackUp, feedbackDown []string
+	if goodwords != "" {
+		feedbackUp = strings.Split(goodwords, ",")
+	}
+	if badwords != "" {
+		feedbackDown = strings.Split(badwords, ",")
+	}
+
+	n := nocino.NewNocino(tgtoken, trustedIDs, plen, gifmaxsize, backupdir, store, nocino.ChatSettings{
+		ReplyLength:  numw,
+		GIFRatio:     gifratio,
+		StickerRatio: stickratio,
+		BothRatio:    bothratio,
+		Learning:     learn,
+		LearnFilter: nocino.LearnFilter{
+			SkipBots:     skipbots,
+			SkipForwards: skipfwd,
+			SkipCommands: skipcmds,
+			MinLength:    learnmin,
+			MaxLength:    learnmax,
+			MaxMarkup:    maxmarkup,
+		},
+		Interjection: nocino.Interjection{
+			Probability: interject,
+			Cooldown:    cooldown,
+			MinMessages: minmsgs,
+			MinUsers:    minusers,
+		},
+		Language:       language,
+		ContentFilters: contentFilters,
+		Aliases:        nameAliases,
+		FeedbackUp:     feedbackUp,
+		FeedbackDown:   feedbackDown,
+		QuietHours:     quiet,
+		RateLimit: nocino.RateLimit{
+			ChatRate:  chatrate,
+			ChatBurst: chatburst,
+			UserRate:  userrate,
+			UserBurst: userburst,
+			CalmDown:  calmdown,
+		},
+	}, log)
+	mchain.SetBlocklist(n.Blocklist)
+	n.RunStatsTicker(mchain, gifdb)
+	if err := handler.SetMyCommands(n.API); err != nil {
+		n.Log.Warnf("Cannot register commands with Telegram: '%s'", err)
+	}
 
 	u := tgbotapi.NewUpdate(0)
 	u.Timeout = 60
@@ -124,11 +274,17 @@ func main() {
 	for update := range updates {
 		// handle update
 		go func(update tgbotapi.Update) {
-			if update.Message == nil || (update.Message.Text == "" && update.Message.Document == nil) {
+			if update.Message == nil && update.EditedMessage == nil && update.CallbackQuery == nil && update.InlineQuery == nil {
+				return
+			}
+			if update.Message != nil && update.Message.Text == "" && update.Message.Document == nil && update.Message.Sticker == nil {
+				return
+			}
+			if update.EditedMessage != nil && update.EditedMessage.Text == "" {
 				return
 			}
 
-			h := handler.NewHandler(n, update, mchain, gifdb)
+			h := handler.NewHandler(n, update, mchain, gifdb, src)
 			if err := h.Handle(); err != nil {
 				n.Log.Errorf("Error when handling incoming message: '%s'", err.Error())
 			}
@@ -36,11 +36,12 @@ func (g *GIFDB) Add(in string) error {
 	return nil
 }
 
-func (g *GIFDB) GetRandom() string {
+// GetRandom returns a GIF from the list, picked with r.
+func (g *GIFDB) GetRandom(r *rand.Rand) string {
 	g.mutex.Lock()
 	defer g.mutex.Unlock()
 
-	return g.List[rand.Intn(len(g.List))]
+	return g.List[r.Intn(len(g.List))]
 
 }
 
@@ -0,0 +1,118 @@
+package handler
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/frapposelli/nocino/pkg/nocino"
+)
+
+func (h *Handler) cmdBlocklist(args string) string {
+	_, global := splitGlobal(args)
+	chatID, errMsg := h.blocklistChat(global)
+	if errMsg != "" {
+		return errMsg
+	}
+	entries, err := h.nocino.Blocklist.Entries(chatID)
+	if err != nil {
+		h.log.Errorf("Cannot load blocklist: '%s'", err)
+		return "Cannot load the blocklist right now"
+	}
+	where := "in this chat"
+	if global {
+		where = "everywhere"
+	}
+	if len(entries) == 0 {
+		return fmt.Sprintf("Nothing is blocked %s", where)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Blocked %s:\n", where)
+	for _, e := range entries {
+		fmt.Fprintf(&b, "%s (%s)\n", e, e.Kind)
+	}
+	return b.String()
+}
+
+func (h *Handler) cmdBlock(args string) string {
+	pattern, global := splitGlobal(args)
+	if pattern == "" {
+		return "Usage: /block <word|stem*|/regex/> [global]"
+	}
+	chatID, errMsg := h.blocklistChat(global)
+	if errMsg != "" {
+		return errMsg
+	}
+	e, err := nocino.ParseBlockEntry(pattern)
+	if err != nil {
+		return fmt.Sprintf("Cannot block that: %s", err)
+	}
+	added, err := h.nocino.Blocklist.Add(chatID, e)
+	if err != nil {
+		h.log.Errorf("Cannot save blocklist: '%s'", err)
+		return fmt.Sprintf("Cannot block that: %s", err)
+	}
+	if !added {
+		return fmt.Sprintf("%s is already blocked", e)
+	}
+	h.log.Infof("Blocked %s in chat %d", e, chatID)
+	if !global {
+		return fmt.Sprintf("Blocked %s, I won't learn it nor say it in this chat", e)
+	}
+
+	// the chain is shared by all chats, so only global entries can be purged
+	removed, err := h.markov.Purge(e.Match)
+	if err != nil {
+		return fmt.Sprintf("Blocked %s everywhere, but cannot forget what I learned about it", e)
+	}
+	return fmt.Sprintf("Blocked %s everywhere and forgot %d transitions", e, removed)
+}
+
+func (h *Handler) cmdUnblock(args string) string {
+	pattern, global := splitGlobal(args)
+	if pattern == "" {
+		return "Usage: /unblock <word|stem*|/regex/> [global]"
+	}
+	chatID, errMsg := h.blocklistChat(global)
+	if errMsg != "" {
+		return errMsg
+	}
+	e, err := nocino.ParseBlockEntry(pattern)
+	if err != nil {
+		return fmt.Sprintf("Cannot unblock that: %s", err)
+	}
+	removed, err := h.nocino.Blocklist.Remove(chatID, e)
+	if err != nil {
+		h.log.Errorf("Cannot save blocklist: '%s'", err)
+		return "Cannot unblock that right now"
+	}
+	if !removed {
+		return fmt.Sprintf("%s is not blocked, see /blocklist", e)
+	}
+	h.log.Infof("Unblocked %s in chat %d", e, chatID)
+	return fmt.Sprintf("Unblocked %s", e)
+}
+
+// splitGlobal splits a trailing "global" off args.
+func splitGlobal(args string) (string, bool) {
+	args = strings.TrimSpace(args)
+	if args == "global" {
+		return "", true
+	}
+	if strings.HasSuffix(args, " global") {
+		return strings.TrimSpace(strings.TrimSuffix(args, " global")), true
+	}
+	return args, false
+}
+
+// blocklistChat returns the chat whose blocklist to use: this one, or 0 for
+// the global one. It returns an error message instead if the sender cannot
+// change the global blocklist.
+func (h *Handler) blocklistChat(global bool) (int64, string) {
+	if !global {
+		return h.update.Message.Chat.ID, ""
+	}
+	if !h.isTrusted() {
+		return 0, "Only trusted users can use the global blocklist"
+	}
+	return 0, ""
+}
@@ -0,0 +1,44 @@
+package handler
+
+import (
+	"strings"
+
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+// callbackFunc handles the press of an inline keyboard button, given the
+// callback data following its prefix. It returns the notification to show
+// to the user, if any.
+type callbackFunc func(h *Handler, data string) string
+
+// callbacks maps the prefix of callback data, up to the first colon, to the
+// function handling the buttons carrying it.
+var callbacks = make(map[string]callbackFunc)
+
+// callbackData returns the callback data of a button handled by the
+// callback registered as prefix.
+func callbackData(prefix string, data string) string {
+	return prefix + ":" + data
+}
+
+// handleCallback routes a button press to its callback and answers it, so
+// the client stops showing it as pending.
+func (h *Handler) handleCallback() error {
+	cq := h.update.CallbackQuery
+	prefix, data := cq.Data, ""
+	if i := strings.Index(cq.Data, ":"); i != -1 {
+		prefix, data = cq.Data[:i], cq.Data[i+1:]
+	}
+
+	var answer string
+	if fn, ok := callbacks[prefix]; ok {
+		h.log.Infof("Running callback '%s' with data '%s'", prefix, data)
+		answer = fn(h, data)
+	} else {
+		h.log.Warnf("Unknown callback data '%s'", cq.Data)
+		answer = "This button does not work anymore"
+	}
+
+	_, err := h.nocino.API.AnswerCallbackQuery(tgbotapi.NewCallback(cq.ID, answer))
+	return err
+}
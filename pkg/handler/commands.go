@@ -0,0 +1,227 @@
+package handler
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+func init() {
+	for _, cmd := range []*Command{
+		{Name: "help", Description: "list the commands you can use", Run: (*Handler).cmdHelp},
+		{Name: "stats", Description: "show what I learned so far", Run: (*Handler).cmdStats},
+		{Name: "explain", Description: "reply to one of my messages to see how I came up with it", Run: (*Handler).cmdExplain},
+		{Name: "feedback", Description: "show how my replies here were rated", Run: (*Handler).cmdFeedback},
+		{Name: "optout", Args: "[here]", Description: "stop me from learning from your messages", Run: (*Handler).cmdOptOut},
+		{Name: "optin", Args: "[here]", Description: "let me learn from your messages again", Run: (*Handler).cmdOptIn},
+		{Name: "settings", Description: "change how I behave here", Permission: PermChatAdmin, Run: (*Handler).cmdSettings},
+		{Name: "language", Args: "[<ISO 639-1 code>|reset]", Description: "show or change the language spoken here", Permission: PermChatAdmin, Run: (*Handler).cmdLanguage},
+		{Name: "interject", Args: "[on|off|reset|<probability>|cooldown <duration>|messages <n>|users <n>]", Description: "show or change how often I talk unprompted here", Permission: PermChatAdmin, Run: (*Handler).cmdInterject},
+		{Name: "ratelimit", Args: "[chat|user <per minute> [burst]|calmdown on|off|reset]", Description: "show or change how often I reply here", Permission: PermChatAdmin, Run: (*Handler).cmdRateLimit},
+		{Name: "triggers", Description: "list the words that summon me here", Run: (*Handler).cmdTriggers},
+		{Name: "addtrigger", Args: "<word or /regex/> [probability] [| reply]", Description: "summon me when a message matches", Permission: PermChatAdmin, Run: (*Handler).cmdAddTrigger},
+		{Name: "deltrigger", Args: "<number or pattern>", Description: "remove a trigger", Permission: PermChatAdmin, Run: (*Handler).cmdDelTrigger},
+		{Name: "blocklist", Args: "[global]", Description: "list the words I never learn nor say here", Permission: PermChatAdmin, Run: (*Handler).cmdBlocklist},
+		{Name: "block", Args: "<word|stem*|/regex/> [global]", Description: "never learn nor say a word", Permission: PermChatAdmin, Run: (*Handler).cmdBlock},
+		{Name: "unblock", Args: "<word|stem*|/regex/> [global]", Description: "remove a word from the blocklist", Permission: PermChatAdmin, Run: (*Handler).cmdUnblock},
+		{Name: "why", Args: "<words>", Description: "show what I learned follows some words", Permission: PermTrusted, Run: (*Handler).cmdWhy},
+		{Name: "neighbors", Args: "<word>", Description: "show what I learned comes before and after a word", Permission: PermTrusted, Run: (*Handler).cmdNeighbors},
+		{Name: "backups", Description: "list state backups", Permission: PermTrusted, PrivateOnly: true, Run: (*Handler).cmdBackups},
+		{Name: "restore", Args: "<backup>", Description: "restore state from a backup", Permission: PermTrusted, PrivateOnly: true, Run: (*Handler).cmdRestore},
+		{Name: "rollback", Description: "undo the last restore", Permission: PermTrusted, PrivateOnly: true, Run: (*Handler).cmdRollback},
+	} {
+		registry.Register(cmd)
+	}
+}
+
+// topTransitions is the number of transitions shown when inspecting the chain.
+const topTransitions = 10
+
+func (h *Handler) cmdBackups(args string) string {
+	backups, err := h.markov.Backups(h.nocino.BackupDir)
+	if err != nil {
+		return fmt.Sprintf("Cannot list backups: %s", err)
+	}
+	if len(backups) == 0 {
+		return "No backups found"
+	}
+	return strings.Join(backups, "\n")
+}
+
+func (h *Handler) cmdRestore(name string) string {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "Usage: /restore <backup name>, see /backups"
+	}
+	// only allow restoring from the backup directory
+	path := filepath.Join(h.nocino.BackupDir, filepath.Base(name))
+	if err := h.markov.Restore(path); err != nil {
+		h.log.Errorf("Restore from '%s' failed with: '%s'", path, err)
+		return fmt.Sprintf("Restore failed: %s", err)
+	}
+	return fmt.Sprintf("Restored state from '%s' (%d suffixes), use /rollback to undo", filepath.Base(path), h.markov.Size())
+}
+
+func (h *Handler) cmdRollback(args string) string {
+	if err := h.markov.Rollback(); err != nil {
+		h.log.Errorf("Rollback failed with: '%s'", err)
+		return fmt.Sprintf("Rollback failed: %s", err)
+	}
+	return fmt.Sprintf("Rolled back state (%d suffixes)", h.markov.Size())
+}
+
+func (h *Handler) cmdStats(args string) string {
+	st, err := h.markov.Stats()
+	if err != nil {
+		h.log.Errorf("Cannot get chain stats: '%s'", err)
+		return "Cannot get stats right now"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Prefixes: %d\n", st.Prefixes)
+	fmt.Fprintf(&b, "Transitions: %d\n", st.Transitions)
+	fmt.Fprintf(&b, "Branching: %.2f avg, %d max\n", st.AvgBranching, st.MaxBranching)
+	fmt.Fprintf(&b, "Vocabulary: %d words\n", st.Vocabulary)
+	fmt.Fprintf(&b, "GIFs: %d\n", len(h.gifdb.List))
+	fmt.Fprintf(&b, "Stickers: %d\n", h.nocino.Store.Stickers())
+	if len(st.TopWords) > 0 {
+		var top []string
+		for _, w := range st.TopWords {
+			top = append(top, fmt.Sprintf("%s (%d)", w.Word, w.Count))
+		}
+		fmt.Fprintf(&b, "Top words: %s\n", strings.Join(top, ", "))
+	}
+	// only trusted users get to see other chats
+	if h.update.Message.Chat.IsPrivate() && h.isTrusted() {
+		for id, n := range st.Chats {
+			fmt.Fprintf(&b, "Chat %d: %d words learned\n", id, n)
+		}
+	} else {
+		fmt.Fprintf(&b, "This chat: %d words learned\n", st.Chats[h.update.Message.Chat.ID])
+	}
+	return b.String()
+}
+
+func (h *Handler) cmdWhy(args string) string {
+	words := strings.Fields(args)
+	if len(words) == 0 {
+		return "Usage: /why <words>"
+	}
+
+	transitions, err := h.markov.Suffixes(words...)
+	if err != nil {
+		h.log.Errorf("Cannot look up suffixes: '%s'", err)
+		return "Cannot look that up right now"
+	}
+	if len(transitions) == 0 {
+		return fmt.Sprintf("Nothing ever followed '%s'", strings.Join(words, " "))
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "After '%s' I learned:\n", strings.Join(words, " "))
+	for i, t := range transitions {
+		if i == topTransitions {
+			fmt.Fprintf(&b, "...and %d more\n", len(transitions)-i)
+			break
+		}
+		fmt.Fprintf(&b, "%s → %s (%d)\n", strings.TrimSpace(t.Prefix), t.Word, t.Weight)
+	}
+	return b.String()
+}
+
+func (h *Handler) cmdNeighbors(args string) string {
+	words := strings.Fields(args)
+	if len(words) != 1 {
+		return "Usage: /neighbors <word>"
+	}
+	word := words[0]
+
+	preds, err := h.markov.Predecessors(word)
+	if err != nil {
+		h.log.Errorf("Cannot look up predecessors: '%s'", err)
+		return "Cannot look that up right now"
+	}
+	succs, err := h.markov.Suffixes(word)
+	if err != nil {
+		h.log.Errorf("Cannot look up suffixes: '%s'", err)
+		return "Cannot look that up right now"
+	}
+	if len(preds) == 0 && len(succs) == 0 {
+		return fmt.Sprintf("I never learned '%s'", word)
+	}
+
+	// group transitions by the word next to ours
+	before := make(map[string]int)
+	for _, t := range preds {
+		p := strings.Split(t.Prefix, " ")
+		before[p[len(p)-1]] += t.Weight
+	}
+	after := make(map[string]int)
+	for _, t := range succs {
+		after[t.Word] += t.Weight
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Before '%s': %s\n", word, topNeighbors(before))
+	fmt.Fprintf(&b, "After '%s': %s\n", word, topNeighbors(after))
+	return b.String()
+}
+
+// topNeighbors formats the heaviest words in neighbors.
+func topNeighbors(neighbors map[string]int) string {
+	var words []string
+	for w := range neighbors {
+		words = append(words, w)
+	}
+	sort.Slice(words, func(i, j int) bool {
+		if neighbors[words[i]] != neighbors[words[j]] {
+			return neighbors[words[i]] > neighbors[words[j]]
+		}
+		return words[i] < words[j]
+	})
+	if len(words) > topTransitions {
+		words = words[:topTransitions]
+	}
+
+	var top []string
+	for _, w := range words {
+		// an empty word is the start of a message
+		if w == "" {
+			top = append(top, fmt.Sprintf("(start) (%d)", neighbors[w]))
+			continue
+		}
+		top = append(top, fmt.Sprintf("%s (%d)", w, neighbors[w]))
+	}
+	if len(top) == 0 {
+		return "nothing"
+	}
+	return strings.Join(top, ", ")
+}
+
+func (h *Handler) cmdExplain(args string) string {
+	orig := h.update.Message.ReplyToMessage
+	if orig == nil || orig.From == nil || orig.From.UserName != h.nocino.API.Self.UserName {
+		return "Reply to one of my messages with /explain"
+	}
+	reply := h.nocino.Replies.Get(orig.Chat.ID, orig.MessageID)
+	if reply == nil || reply.Trace == nil {
+		return "I don't remember how I came up with that"
+	}
+
+	var b strings.Builder
+	t := reply.Trace
+	fmt.Fprintf(&b, "Asked: '%s'\n", t.Seed)
+	if len(t.Candidates) > 0 {
+		fmt.Fprintf(&b, "Seed candidates: %s\n", strings.Join(t.Candidates, ", "))
+	}
+	if t.Chosen != "" {
+		fmt.Fprintf(&b, "Started from: '%s'\n", t.Chosen)
+	} else {
+		b.WriteString("Started from scratch\n")
+	}
+	for i, s := range t.Steps {
+		fmt.Fprintf(&b, "%d. [%s] %d choices → %s\n", i+1, strings.TrimSpace(s.Prefix), s.Choices, s.Word)
+	}
+	return b.String()
+}
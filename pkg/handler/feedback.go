@@ -0,0 +1,99 @@
+package handler
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/frapposelli/nocino/pkg/markov"
+)
+
+func (h *Handler) cmdFeedback(args string) string {
+	f, err := h.nocino.Store.Feedback(h.update.Message.Chat.ID)
+	if err != nil {
+		h.log.Errorf("Cannot load feedback: '%s'", err)
+		return "Cannot load the feedback of this chat right now"
+	}
+	if f.Up+f.Down == 0 {
+		return "Nobody rated my replies here yet"
+	}
+	return fmt.Sprintf("My replies here got %d 👍 and %d 👎 (%.0f%% liked)", f.Up, f.Down, float64(f.Up)*100/float64(f.Up+f.Down))
+}
+
+// replyFeedback returns true if the message replies to one of ours with
+// nothing but feedback words, and the vote was recorded. Votes are only taken
+// with weighted generation, the only one they have an effect on.
+func (h *Handler) replyFeedback() bool {
+	orig := h.update.Message.ReplyToMessage
+	if !h.markov.Weighted() || orig == nil || orig.From == nil || orig.From.UserName != h.nocino.API.Self.UserName {
+		return false
+	}
+	var up, down bool
+	for _, w := range strings.Fields(h.update.Message.Text) {
+		w = strings.TrimFunc(w, unicode.IsPunct)
+		switch {
+		case w == "":
+		case containsFold(h.settings.FeedbackUp, w):
+			up = true
+		case containsFold(h.settings.FeedbackDown, w):
+			down = true
+		default:
+			// more than feedback, answer it
+			return false
+		}
+	}
+	if up == down {
+		return false
+	}
+	vote := 1
+	if down {
+		vote = -1
+	}
+	_, ok := h.feedback(orig.Chat.ID, orig.MessageID, vote)
+	return ok
+}
+
+// feedback records the vote of the sender on the reply with messageID in
+// chatID, nudging the transitions it was built with accordingly. It returns
+// the notification to show to the sender, and true if the vote was recorded.
+func (h *Handler) feedback(chatID int64, messageID int, vote int) (string, bool) {
+	if !h.markov.Weighted() {
+		return "Votes have no effect on my replies", false
+	}
+	reply := h.nocino.Replies.Get(chatID, messageID)
+	if reply == nil || reply.Trace == nil {
+		return "I don't remember how I came up with that", false
+	}
+	var changed int
+	prev, ok, err := h.nocino.Replies.Vote(chatID, messageID, h.from().ID, vote, func(prev map[markov.Step]int) (map[markov.Step]int, error) {
+		applied, err := h.markov.Reinforce(reply.Trace, vote, prev)
+		changed = len(applied)
+		return applied, err
+	})
+	switch {
+	case !ok, err == markov.ErrForgotten:
+		return "I don't remember how I came up with that", false
+	case err != nil:
+		return "Cannot learn from that right now", false
+	case prev == vote:
+		return "You already rated this", true
+	}
+
+	if err := h.nocino.Store.AddFeedback(chatID, prev, vote); err != nil {
+		h.log.Errorf("Cannot save feedback: '%s'", err)
+	}
+	h.log.Infof("Feedback %+d on reply %d in chat %d, %d transitions nudged", vote, messageID, chatID, changed)
+	if vote > 0 {
+		return "Glad you liked it", true
+	}
+	return "I'll try to do better", true
+}
+
+func containsFold(words []string, w string) bool {
+	for _, word := range words {
+		if word = strings.TrimSpace(word); word != "" && strings.EqualFold(word, w) {
+			return true
+		}
+	}
+	return false
+}
@@ -20,22 +20,61 @@ type Handler struct {
 	update tgbotapi.Update
 	markov *markov.Chain
 	gifdb  *gif.GIFDB
+	rand   *rand.Rand
 	log    *logrus.Entry
+	// chatAdmin caches whether the sender administers the chat.
+	chatAdmin *bool
+	// trigger is the chat trigger the message matched, if any.
+	trigger *nocino.Trigger
+	// settings are the settings of the chat the update comes from.
+	settings nocino.ChatSettings
 }
 
-func NewHandler(nocino *nocino.Nocino, update tgbotapi.Update, markov *markov.Chain, gifdb *gif.GIFDB) *Handler {
-	loghandler := nocino.Log.WithFields(logrus.Fields{
-		"username":  update.Message.From.UserName,
-		"subsystem": "handler",
-	})
-
-	return &Handler{
+// NewHandler returns a Handler for update, drawing random numbers from src.
+// src is shared by all handlers; if nil, one seeded with the current time is
+// used.
+func NewHandler(nocino *nocino.Nocino, update tgbotapi.Update, mchain *markov.Chain, gifdb *gif.GIFDB, src rand.Source) *Handler {
+	h := &Handler{
 		nocino: nocino,
 		update: update,
-		markov: markov,
+		markov: mchain,
 		gifdb:  gifdb,
-		log:    loghandler,
+		rand:   rand.New(markov.LockSource(src)),
+	}
+	// edits are handled as messages, Handle only relearns them
+	if update.EditedMessage != nil {
+		h.update.Message = update.EditedMessage
+	}
+	h.log = nocino.Log.WithFields(logrus.Fields{
+		"username":  h.from().UserName,
+		"subsystem": "handler",
+	})
+	return h
+}
+
+// from returns the user who sent the update.
+func (h *Handler) from() *tgbotapi.User {
+	if h.update.CallbackQuery != nil {
+		return h.update.CallbackQuery.From
+	}
+	if h.update.InlineQuery != nil {
+		return h.update.InlineQuery.From
 	}
+	return h.update.Message.From
+}
+
+// chat returns the chat the update comes from, or nil if there is none.
+func (h *Handler) chat() *tgbotapi.Chat {
+	if h.update.CallbackQuery != nil {
+		if h.update.CallbackQuery.Message == nil {
+			return nil
+		}
+		return h.update.CallbackQuery.Message.Chat
+	}
+	if h.update.InlineQuery != nil {
+		return nil
+	}
+	return h.update.Message.Chat
 }
 
 func (h *Handler) Handle() error {
@@ -44,41 +83,174 @@ func (h *Handler) Handle() error {
 
 	h.log.Debugf("Incoming message: %#v", spew.Sdump(h.update))
 
+	if h.update.CallbackQuery != nil {
+		return h.handleCallback()
+	}
+	if h.update.InlineQuery != nil {
+		return h.handleInline()
+	}
+
+	// hearing from a chat means we can talk to it again
+	h.nocino.Outbox.Activate(h.update.Message.Chat.ID)
+
+	settings, err := h.nocino.Settings(h.update.Message.Chat.ID)
+	if err != nil {
+		h.log.Errorf("Cannot load chat settings, using defaults: '%s'", err)
+	}
+	h.settings = settings
+
+	if h.update.EditedMessage != nil {
+		h.saveMessage(h.tokenize())
+		return nil
+	}
+
+	if ok, err := h.dispatchCommand(); ok {
+		return err
+	}
+
 	answerRequired, tokens = h.processMessage()
 
 	defer h.saveMessage(tokens)
 
+	asked := answerRequired
+	if !h.update.Message.Chat.IsPrivate() {
+		h.nocino.Activity.Record(h.update.Message.Chat.ID, h.update.Message.From.ID, time.Now())
+		if !answerRequired {
+			answerRequired = h.interject()
+		}
+	}
+
+	if answerRequired && h.settings.QuietHours.Contains(time.Now()) {
+		h.log.Infof("Not answering during quiet hours (%s)", h.settings.QuietHours)
+		return nil
+	}
+	if answerRequired && !h.withinRateLimit(asked) {
+		return nil
+	}
 	if answerRequired {
-		if dice := h.rollDice(); dice > 3 && len(h.gifdb.List) > 0 {
-			h.nocino.API.Send(h.fetchGIF())
+		return h.reply()
+	}
+
+	return nil
+
+}
+
+// reply answers the message with some generated text, a GIF, a sticker or a
+// GIF and text, as chosen by the reply policy of the chat.
+func (h *Handler) reply() error {
+	if h.trigger != nil && h.trigger.Reply != "" {
+		if !h.sendable(h.update.Message.Chat.ID, h.trigger.Reply) {
 			return nil
 		}
-		h.nocino.API.Send(h.genText())
+		h.log.Infof("Sending trigger reply: '%s'", h.trigger.Reply)
+		msg := tgbotapi.NewMessage(h.update.Message.Chat.ID, h.trigger.Reply)
+		msg.ReplyToMessageID = h.update.Message.MessageID
+		_, err := h.nocino.Outbox.Send(h.update.Message.Chat.ID, msg)
+		return err
+	}
+
+	policy := replyPolicy{
+		settings: h.settings,
+		gifs:     len(h.gifdb.List) > 0,
+		stickers: h.nocino.Store.HasStickers(),
+	}
+	kind, reason := policy.choose(h.update.Message, h.rand)
+	h.log.Debugf("Replying with %s (%s)", kind, reason)
+	switch kind {
+	case replyGIF:
+		_, err := h.nocino.Outbox.Send(h.update.Message.Chat.ID, h.fetchGIF())
+		return err
+	case replySticker:
+		return h.sendSticker()
+	case replyBoth:
+		if _, err := h.nocino.Outbox.Send(h.update.Message.Chat.ID, h.fetchGIF()); err != nil {
+			return err
+		}
 	}
+	return h.sendText()
+}
 
+// sendText replies with generated text, remembering how it was generated.
+func (h *Handler) sendText() error {
+	msg, trace := h.genText()
+	if !h.sendable(msg.ChatID, msg.Text) {
+		return nil
+	}
+	msg.ReplyMarkup = replyKeyboard(h.markov.Weighted())
+	sent, err := h.nocino.Outbox.Send(h.update.Message.Chat.ID, msg)
+	if err != nil {
+		return err
+	}
+	h.nocino.Replies.Add(&nocino.Reply{
+		ChatID:    sent.Chat.ID,
+		MessageID: sent.MessageID,
+		AskerID:   h.update.Message.From.ID,
+		Trace:     trace,
+		Sent:      time.Now(),
+	})
 	return nil
+}
+
+// sendable returns false if generated text must not be sent to chatID,
+// because it matches a content filter or contains a blocked word.
+func (h *Handler) sendable(chatID int64, text string) bool {
+	if h.settings.Filtered(text) {
+		h.log.Infof("Not sending filtered response: '%s'", text)
+		return false
+	}
+	if w, ok := h.nocino.Blocklist.Contains(chatID, text); ok {
+		h.log.Warnf("Not sending response with blocked word '%s': '%s'", w, text)
+		return false
+	}
+	return true
+}
 
+// interject returns true if we should reply to a group message nobody asked
+// us about, when the chat is busy enough and we kept quiet for a while.
+func (h *Handler) interject() bool {
+	if h.update.Message.Text == "" {
+		return false
+	}
+	chatID := h.update.Message.Chat.ID
+	cfg := h.settings.Interjection
+	if cfg.Probability <= 0 {
+		return false
+	}
+	if messages, users := h.nocino.Activity.Recent(chatID); messages < cfg.MinMessages || users < cfg.MinUsers {
+		return false
+	}
+	if h.rand.Float64() >= cfg.Probability || !h.nocino.Activity.TryInterject(chatID, cfg.Cooldown) {
+		return false
+	}
+	h.log.Infof("Interjecting, seeded with: '%s'", h.update.Message.Text)
+	return true
 }
 
-func (h *Handler) rollDice() int {
-	dice := []int{1, 2, 3, 4, 5, 6}
-	rand.Seed(time.Now().UnixNano())
-	return dice[rand.Intn(len(dice)-1)]
+func (h *Handler) sendSticker() error {
+	fileID, err := h.nocino.Store.RandomSticker(h.rand)
+	if err != nil || fileID == "" {
+		return err
+	}
+	h.log.Infof("Sending sticker: %s", fileID)
+	msg := tgbotapi.NewStickerShare(h.update.Message.Chat.ID, fileID)
+	msg.ReplyToMessageID = h.update.Message.MessageID
+	_, err = h.nocino.Outbox.Send(h.update.Message.Chat.ID, msg)
+	return err
 }
 
-func (h *Handler) genText() tgbotapi.Chattable {
+func (h *Handler) genText() (tgbotapi.MessageConfig, *markov.Trace) {
 	// Generate a Markov Chain
-	genText, elapsed := h.markov.GenerateChain(h.nocino.Numw, h.update.Message.Text)
+	genText, trace, elapsed := h.markov.GenerateChainTrace(h.update.Message.Chat.ID, h.settings.ReplyLength, strings.Join(h.tokenize(), " "))
 	h.log.WithField("elapsed", elapsed.String()).Infof("Sending response: '%s'", genText)
 	// Compose message
 	msg := tgbotapi.NewMessage(h.update.Message.Chat.ID, genText)
 	msg.ReplyToMessageID = h.update.Message.MessageID
 
-	return msg
+	return msg, trace
 }
 
 func (h *Handler) fetchGIF() tgbotapi.Chattable {
-	gifpick := fmt.Sprintf("%s/%s", h.gifdb.Store, h.gifdb.GetRandom())
+	gifpick := fmt.Sprintf("%s/%s", h.gifdb.Store, h.gifdb.GetRandom(h.rand))
 	h.log.Infof("Sending GIF: %s", gifpick)
 	msg := tgbotapi.NewDocumentUpload(h.update.Message.Chat.ID, gifpick)
 	msg.ReplyToMessageID = h.update.Message.MessageID
@@ -87,10 +259,51 @@ func (h *Handler) fetchGIF() tgbotapi.Chattable {
 }
 
 func (h *Handler) saveMessage(tokens []string) {
-	if len(tokens) > 0 {
+	optedOut, err := h.nocino.Store.OptedOut(h.update.Message.From.ID, h.update.Message.Chat.ID)
+	if err != nil {
+		h.log.Errorf("Cannot check opt-out, not saving message: '%s'", err)
+		return
+	}
+
+	text := strings.Join(tokens, " ")
+	learn := false
+	switch {
+	case optedOut:
+		h.log.Debugf("User opted out of learning, not saving message")
+	case strings.TrimSpace(text) == "":
+	default:
+		if reason := h.skipLearning(text); reason != "" {
+			h.log.Debugf("Not saving message, %s", reason)
+		} else {
+			learn = true
+		}
+	}
+
+	chatID, messageID := h.update.Message.Chat.ID, h.update.Message.MessageID
+	if h.update.EditedMessage != nil {
+		// forget the previous version even if we cannot learn this one
+		if !learn {
+			text = ""
+		}
+		h.log.Debugf("Replacing message %d in Chain with '%s'", messageID, text)
+		h.markov.EditMessage(chatID, messageID, text)
+		return
+	}
+	if learn {
 		// add message to chain
 		h.log.Debugf("Saving tokens to Chain '%v'", tokens)
-		h.markov.AddChain(strings.Join(tokens, " "))
+		h.markov.AddMessage(chatID, h.from().ID, messageID, text)
+	}
+	// stickers and GIFs are sent in other chats, like what we learn
+	if optedOut || !h.settings.Learning {
+		return
+	}
+
+	if h.update.Message.Sticker != nil {
+		h.log.Debugf("Saving sticker '%s'", h.update.Message.Sticker.FileID)
+		if err := h.nocino.Store.AddSticker(h.update.Message.Sticker.FileID); err != nil {
+			h.log.Errorf("Could not save sticker due to error '%s'", err)
+		}
 	}
 
 	if h.update.Message.Document != nil && (h.update.Message.Document.MimeType == "video/mp4" && h.update.Message.Document.FileSize < h.nocino.GIFmaxsize) {
@@ -114,9 +327,21 @@ func (h *Handler) checkTrustedID(userid int) bool {
 	return false
 }
 
+// tokenize returns the words of the message, without the mentions of the
+// bot.
+func (h *Handler) tokenize() []string {
+	_, text := h.parseMention()
+	return strings.Fields(text)
+}
+
 func (h *Handler) processMessage() (answerRequired bool, tokens []string) {
 	// tokenize message
-	tokens = strings.Split(h.update.Message.Text, " ")
+	tokens = h.tokenize()
+
+	// feedback on one of our replies needs no answer
+	if h.replyFeedback() {
+		return
+	}
 
 	// if it's a private message and it's trusted, reply
 	if h.update.Message.Chat.Type == "private" {
@@ -136,13 +361,19 @@ func (h *Handler) processMessage() (answerRequired bool, tokens []string) {
 	}
 
 	// check if we're being mentioned, answer back if necessary.
-	if strings.ToLower(tokens[0]) == strings.ToLower(h.nocino.BotUsername) {
-		// pop the first element
-		tokens = tokens[1:]
+	if mentioned, _ := h.parseMention(); mentioned {
 		h.log.Infof("Mention to us, asking: '%s'", strings.Join(tokens, " "))
 		answerRequired = true
 		return
 	}
 
+	// check if the message matches one of the chat triggers
+	if t := h.matchTrigger(); t != nil {
+		h.log.Infof("Trigger '%s' matched, asking: '%s'", t.Pattern, h.update.Message.Text)
+		h.trigger = t
+		answerRequired = true
+		return
+	}
+
 	return
 }
@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/frapposelli/nocino/pkg/nocino"
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+const (
+	// inlineResults is the number of texts suggested to inline queries.
+	inlineResults = 3
+	// inlineCacheTime is how long, in seconds, Telegram keeps the answer to
+	// an inline query before asking again.
+	inlineCacheTime = 30
+)
+
+// inlineLimiter limits the inline queries of each user apart from replies,
+// and more loosely, since Telegram sends one at almost every keystroke.
+var (
+	inlineLimiter   = nocino.NewLimiter()
+	inlineRateLimit = nocino.RateLimit{ChatRate: 60, ChatBurst: 20}
+)
+
+// inlineCachedDocument is an inline result sending a file Telegram already
+// has, which the bot API library lacks.
+type inlineCachedDocument struct {
+	Type           string `json:"type"`
+	ID             string `json:"id"`
+	Title          string `json:"title"`
+	DocumentFileID string `json:"document_file_id"`
+}
+
+// handleInline answers an inline query with texts seeded by the query, and a
+// GIF if we hoarded any. Texts follow the settings of the private chat with
+// the user asking.
+func (h *Handler) handleInline() error {
+	q := h.update.InlineQuery
+	chatID := int64(q.From.ID)
+	settings, err := h.nocino.Settings(chatID)
+	if err != nil {
+		h.log.Errorf("Cannot load user settings, using defaults: '%s'", err)
+	}
+	h.settings = settings
+
+	if allowed, _, _ := inlineLimiter.Allow(chatID, 0, inlineRateLimit); !allowed {
+		h.log.Debugf("User over rate limit, ignoring inline query: '%s'", q.Query)
+		return nil
+	}
+
+	var results []interface{}
+	seen := make(map[string]bool)
+	for i := 0; i < inlineResults; i++ {
+		text, _, _ := h.markov.GenerateChainTrace(chatID, h.settings.ReplyLength, strings.TrimSpace(q.Query))
+		if text == "" || seen[text] || !h.sendable(chatID, text) {
+			continue
+		}
+		seen[text] = true
+		results = append(results, tgbotapi.NewInlineQueryResultArticle(strconv.Itoa(len(results)), text, text))
+	}
+	if len(h.gifdb.List) > 0 {
+		gifpick := h.gifdb.GetRandom(h.rand)
+		results = append(results, inlineCachedDocument{
+			Type:  "document",
+			ID:    "gif",
+			Title: "Random GIF",
+			// hoarded GIFs are named after their file ID
+			DocumentFileID: strings.TrimSuffix(gifpick, ".mp4"),
+		})
+	}
+	h.log.Debugf("Answering inline query '%s' with %d results", q.Query, len(results))
+
+	_, err = h.nocino.API.AnswerInlineQuery(tgbotapi.InlineConfig{
+		InlineQueryID: q.ID,
+		Results:       results,
+		CacheTime:     inlineCacheTime,
+		IsPersonal:    true,
+	})
+	return err
+}
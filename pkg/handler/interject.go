@@ -0,0 +1,104 @@
+package handler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/frapposelli/nocino/pkg/nocino"
+)
+
+// defaultInterjectProbability is used by "/interject on" when interjections
+// are disabled by default.
+const defaultInterjectProbability = 0.02
+
+const interjectUsage = "Usage: /interject [on|off|reset|<probability>|cooldown <duration>|messages <n>|users <n>]"
+
+func (h *Handler) cmdInterject(args string) string {
+	if h.update.Message.Chat.IsPrivate() {
+		return "I only interject in groups"
+	}
+	chatID := h.update.Message.Chat.ID
+	settings, err := h.nocino.Settings(chatID)
+	if err != nil {
+		h.log.Errorf("Cannot load chat settings: '%s'", err)
+		return "Cannot load the settings of this chat right now"
+	}
+	cfg := &settings.Interjection
+
+	fields := strings.Fields(strings.ToLower(args))
+	switch {
+	case len(fields) == 0:
+		return formatInterjection(*cfg)
+	case len(fields) == 1 && fields[0] == "reset":
+		*cfg = h.nocino.Defaults.Interjection
+	case len(fields) == 1 && fields[0] == "off":
+		cfg.Probability = 0
+	case len(fields) == 1 && fields[0] == "on":
+		cfg.Probability = h.nocino.Defaults.Interjection.Probability
+		if cfg.Probability <= 0 {
+			cfg.Probability = defaultInterjectProbability
+		}
+	case len(fields) == 1:
+		p, err := parseProbability(fields[0])
+		if err != nil {
+			return interjectUsage
+		}
+		cfg.Probability = p
+	case len(fields) == 2 && fields[0] == "cooldown":
+		d, err := time.ParseDuration(fields[1])
+		if err != nil || d < 0 {
+			return "Usage: /interject cooldown <duration>, like 30m or 2h"
+		}
+		cfg.Cooldown = d
+	case len(fields) == 2 && (fields[0] == "messages" || fields[0] == "users"):
+		n, err := strconv.Atoi(fields[1])
+		if err != nil || n < 0 {
+			return fmt.Sprintf("Usage: /interject %s <n>", fields[0])
+		}
+		if fields[0] == "messages" {
+			cfg.MinMessages = n
+		} else {
+			cfg.MinUsers = n
+		}
+	default:
+		return interjectUsage
+	}
+
+	if err := h.nocino.SetSettings(chatID, &settings); err != nil {
+		h.log.Errorf("Cannot save chat settings: '%s'", err)
+		return "Cannot save the settings of this chat right now"
+	}
+	h.log.Infof("Interjection settings of chat %d changed to %+v", chatID, *cfg)
+	return formatInterjection(*cfg)
+}
+
+func formatInterjection(cfg nocino.Interjection) string {
+	if cfg.Probability <= 0 {
+		return "Interjections are off"
+	}
+	return fmt.Sprintf("Interjecting %s of the time, at most once every %s, when at least %d people sent %d messages in the last %s",
+		formatProbability(cfg.Probability), cfg.Cooldown, cfg.MinUsers, cfg.MinMessages, nocino.ActivityWindow)
+}
+
+// parseProbability parses a probability written either as a fraction, like
+// 0.05, or as a percentage, like 5%.
+func parseProbability(s string) (float64, error) {
+	percent := strings.HasSuffix(s, "%")
+	p, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil {
+		return 0, err
+	}
+	if percent {
+		p /= 100
+	}
+	if p < 0 || p > 1 {
+		return 0, fmt.Errorf("probability '%s' out of range", s)
+	}
+	return p, nil
+}
+
+func formatProbability(p float64) string {
+	return strconv.FormatFloat(p*100, 'f', -1, 64) + "%"
+}
@@ -0,0 +1,106 @@
+package handler
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/frapposelli/nocino/pkg/nocino"
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+// learnRule returns why a message should not be learned, or an empty string
+// if it can be. text is the part of the message that would be learned.
+type learnRule func(m *tgbotapi.Message, text string) string
+
+// learnRules returns the rules enabled by the settings of a chat, in the
+// order they are checked.
+func learnRules(s nocino.ChatSettings) []learnRule {
+	f := s.LearnFilter
+	rules := []learnRule{
+		func(m *tgbotapi.Message, text string) string {
+			if !s.Learning {
+				return "learning is disabled"
+			}
+			return ""
+		},
+	}
+	if f.SkipBots {
+		rules = append(rules, func(m *tgbotapi.Message, text string) string {
+			if m.From != nil && m.From.IsBot {
+				return "sent by a bot"
+			}
+			return ""
+		})
+	}
+	if f.SkipForwards {
+		rules = append(rules, func(m *tgbotapi.Message, text string) string {
+			if m.ForwardFrom != nil || m.ForwardFromChat != nil {
+				return "forwarded"
+			}
+			return ""
+		})
+	}
+	if f.SkipCommands {
+		rules = append(rules, func(m *tgbotapi.Message, text string) string {
+			if m.IsCommand() || strings.HasPrefix(text, "/") {
+				return "a command"
+			}
+			return ""
+		})
+	}
+	if f.MinLength > 0 || f.MaxLength > 0 {
+		rules = append(rules, func(m *tgbotapi.Message, text string) string {
+			n := utf8.RuneCountInString(text)
+			switch {
+			case f.MinLength > 0 && n < f.MinLength:
+				return fmt.Sprintf("shorter than %d characters", f.MinLength)
+			case f.MaxLength > 0 && n > f.MaxLength:
+				return fmt.Sprintf("longer than %d characters", f.MaxLength)
+			}
+			return ""
+		})
+	}
+	if f.MaxMarkup > 0 {
+		rules = append(rules, func(m *tgbotapi.Message, text string) string {
+			if share := markupShare(m); share > f.MaxMarkup {
+				return fmt.Sprintf("%.0f%% URLs or code", share*100)
+			}
+			return ""
+		})
+	}
+	rules = append(rules, func(m *tgbotapi.Message, text string) string {
+		if s.Filtered(text) {
+			return "matches a content filter"
+		}
+		return ""
+	})
+	return rules
+}
+
+// skipLearning runs the message through the learning rules of the chat,
+// returning why it should not be learned, or an empty string if it can be.
+func (h *Handler) skipLearning(text string) string {
+	for _, rule := range learnRules(h.settings) {
+		if reason := rule(h.update.Message, text); reason != "" {
+			return reason
+		}
+	}
+	return ""
+}
+
+// markupShare returns the share of the message text covered by URLs and
+// code entities.
+func markupShare(m *tgbotapi.Message) float64 {
+	if m.Entities == nil || m.Text == "" {
+		return 0
+	}
+	var markup int
+	for _, e := range *m.Entities {
+		switch e.Type {
+		case "url", "code", "pre":
+			markup += e.Length
+		}
+	}
+	return float64(markup) / float64(len(entityUnits(m.Text)))
+}
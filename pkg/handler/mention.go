@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf16"
+)
+
+// parseMention returns true if the message addresses the bot, with a mention
+// of its username or a text mention of its user anywhere in the text, or with
+// one of the chat aliases as a whole word. It also returns the text with those
+// mentions removed, to seed replies and to learn.
+func (h *Handler) parseMention() (bool, string) {
+	m := h.update.Message
+	var mentioned bool
+	text := m.Text
+	if m.Entities != nil {
+		units := entityUnits(m.Text)
+		var kept []uint16
+		last := 0
+		for _, e := range *m.Entities {
+			if e.Offset < last || e.Offset+e.Length > len(units) {
+				continue
+			}
+			entity := string(utf16.Decode(units[e.Offset : e.Offset+e.Length]))
+			switch {
+			case e.Type == "mention" && strings.EqualFold(entity, h.nocino.BotUsername):
+			case e.Type == "text_mention" && e.User != nil && e.User.ID == h.nocino.API.Self.ID:
+			default:
+				continue
+			}
+			mentioned = true
+			kept = append(kept, units[last:e.Offset]...)
+			last = e.Offset + e.Length
+		}
+		if mentioned {
+			text = string(utf16.Decode(append(kept, units[last:]...)))
+		}
+	}
+
+	var words []string
+	for _, w := range strings.Fields(text) {
+		if h.isOurName(w) {
+			mentioned = true
+			continue
+		}
+		words = append(words, w)
+	}
+	return mentioned, strings.Join(words, " ")
+}
+
+// isOurName returns true if word, ignoring case and the punctuation around
+// it, is the bot username or one of the chat aliases.
+func (h *Handler) isOurName(word string) bool {
+	word = strings.TrimFunc(word, func(r rune) bool {
+		return unicode.IsPunct(r) && r != '@' && r != '_'
+	})
+	if strings.EqualFold(word, h.nocino.BotUsername) {
+		return true
+	}
+	for _, alias := range h.settings.Aliases {
+		if alias = strings.TrimSpace(alias); alias != "" && strings.EqualFold(word, alias) {
+			return true
+		}
+	}
+	return false
+}
+
+// entityUnits returns text as UTF-16 code units, what the offsets and lengths
+// of message entities count.
+func entityUnits(text string) []uint16 {
+	return utf16.Encode([]rune(text))
+}
@@ -0,0 +1,89 @@
+package handler
+
+import (
+	"testing"
+
+	"github.com/frapposelli/nocino/pkg/nocino"
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+func TestParseMention(t *testing.T) {
+	tests := []struct {
+		name      string
+		text      string
+		entities  []tgbotapi.MessageEntity
+		mentioned bool
+		want      string
+	}{
+		{
+			name: "no mention",
+			text: "hello there",
+			want: "hello there",
+		},
+		{
+			name:      "mention at the start",
+			text:      "@nocinobot hello there",
+			entities:  []tgbotapi.MessageEntity{{Type: "mention", Offset: 0, Length: 10}},
+			mentioned: true,
+			want:      "hello there",
+		},
+		{
+			// the emoji takes two UTF-16 code units
+			name:      "mention after an emoji",
+			text:      "😀 @nocinobot hello",
+			entities:  []tgbotapi.MessageEntity{{Type: "mention", Offset: 3, Length: 10}},
+			mentioned: true,
+			want:      "😀 hello",
+		},
+		{
+			name:      "text mention after emojis",
+			text:      "🐱🐶 Nocino what's up 🎉",
+			entities:  []tgbotapi.MessageEntity{{Type: "text_mention", Offset: 5, Length: 6, User: &tgbotapi.User{ID: 99}}},
+			mentioned: true,
+			want:      "🐱🐶 what's up 🎉",
+		},
+		{
+			name:     "mention of someone else",
+			text:     "😀 @someone hello",
+			entities: []tgbotapi.MessageEntity{{Type: "mention", Offset: 3, Length: 8}},
+			want:     "😀 @someone hello",
+		},
+		{
+			name:     "entity past the end",
+			text:     "😀 @someone",
+			entities: []tgbotapi.MessageEntity{{Type: "mention", Offset: 3, Length: 20}},
+			want:     "😀 @someone",
+		},
+		{
+			name:      "alias",
+			text:      "hey noci, how are you?",
+			mentioned: true,
+			want:      "hey how are you?",
+		},
+		{
+			name: "alias within a word",
+			text: "nocinone is not us",
+			want: "nocinone is not us",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &tgbotapi.Message{Text: tt.text}
+			if tt.entities != nil {
+				m.Entities = &tt.entities
+			}
+			h := &Handler{
+				nocino: &nocino.Nocino{
+					BotUsername: "@nocinobot",
+					API:         &tgbotapi.BotAPI{Self: tgbotapi.User{ID: 99, UserName: "nocinobot"}},
+				},
+				update:   tgbotapi.Update{Message: m},
+				settings: nocino.ChatSettings{Aliases: []string{"nocino", "noci"}},
+			}
+			mentioned, text := h.parseMention()
+			if mentioned != tt.mentioned || text != tt.want {
+				t.Errorf("parseMention() = %t, '%s', want %t, '%s'", mentioned, text, tt.mentioned, tt.want)
+			}
+		})
+	}
+}
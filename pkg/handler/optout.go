@@ -0,0 +1,49 @@
+package handler
+
+import (
+	"strings"
+)
+
+func (h *Handler) cmdOptOut(args string) string {
+	return h.setOptOut(args, true)
+}
+
+func (h *Handler) cmdOptIn(args string) string {
+	return h.setOptOut(args, false)
+}
+
+// setOptOut records whether the sender wants to be learned from, everywhere
+// or only in this chat if args is "here".
+func (h *Handler) setOptOut(args string, out bool) string {
+	args = strings.ToLower(strings.TrimSpace(args))
+	if args != "" && args != "here" {
+		if out {
+			return "Usage: /optout [here]"
+		}
+		return "Usage: /optin [here]"
+	}
+	global := args == ""
+
+	chatID := h.update.Message.Chat.ID
+	if err := h.nocino.Store.SetOptOut(h.from().ID, chatID, global, out); err != nil {
+		h.log.Errorf("Cannot save opt-out: '%s'", err)
+		return "Cannot save that right now"
+	}
+	h.log.Infof("User changed learning opt-out to %t (global: %t, chat: %d)", out, global, chatID)
+	if out {
+		// the learned messages can no longer be edited once the user is out
+		if _, err := h.markov.ForgetUser(h.from().ID, chatID, global); err != nil {
+			h.log.Errorf("Cannot forget messages of opted-out user: '%s'", err)
+		}
+	}
+
+	switch {
+	case out && global:
+		return "I won't learn from your messages anymore, I'll still answer you. Use /optin to undo"
+	case out:
+		return "I won't learn from your messages in this chat anymore, I'll still answer you. Use /optin here to undo"
+	case global:
+		return "I'll learn from your messages again"
+	}
+	return "I'll learn from your messages in this chat again"
+}
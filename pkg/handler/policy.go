@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"math/rand"
+	"strings"
+
+	"github.com/frapposelli/nocino/pkg/nocino"
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+// replyKind is the kind of reply sent to a message.
+type replyKind int
+
+const (
+	replyText replyKind = iota
+	replyGIF
+	replySticker
+	// replyBoth is a GIF followed by some text.
+	replyBoth
+)
+
+func (k replyKind) String() string {
+	switch k {
+	case replyGIF:
+		return "GIF"
+	case replySticker:
+		return "sticker"
+	case replyBoth:
+		return "GIF and text"
+	}
+	return "text"
+}
+
+// replyPolicy chooses the kind of reply to a message, using the odds set for
+// the chat unless the message calls for a specific kind.
+type replyPolicy struct {
+	settings nocino.ChatSettings
+	// gifs and stickers tell whether we have any to send.
+	gifs     bool
+	stickers bool
+}
+
+// choose returns the kind of reply to m, and why it was chosen.
+func (p replyPolicy) choose(m *tgbotapi.Message, r *rand.Rand) (replyKind, string) {
+	switch {
+	case isGIF(m) && p.gifs:
+		return replyGIF, "GIF for a GIF"
+	case m.Sticker != nil && p.stickers:
+		return replySticker, "sticker for a sticker"
+	case strings.HasSuffix(strings.TrimSpace(m.Text), "?"):
+		return replyText, "answering a question"
+	}
+
+	gif, sticker, both := p.settings.GIFRatio, p.settings.StickerRatio, p.settings.BothRatio
+	if !p.gifs {
+		gif, both = 0, 0
+	}
+	if !p.stickers {
+		sticker = 0
+	}
+	// scale the odds down if they add up to more than 1
+	if total := gif + sticker + both; total > 1 {
+		gif, sticker, both = gif/total, sticker/total, both/total
+	}
+
+	switch n := r.Float64(); {
+	case n < gif:
+		return replyGIF, "rolled"
+	case n < gif+sticker:
+		return replySticker, "rolled"
+	case n < gif+sticker+both:
+		return replyBoth, "rolled"
+	}
+	return replyText, "rolled"
+}
+
+// isGIF returns true if m carries a GIF, which Telegram sends as an MP4
+// document.
+func isGIF(m *tgbotapi.Message) bool {
+	return m.Document != nil && m.Document.MimeType == "video/mp4"
+}
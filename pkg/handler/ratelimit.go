@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/frapposelli/nocino/pkg/nocino"
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+const rateLimitUsage = "Usage: /ratelimit [chat|user <per minute> [burst]|calmdown on|off|reset]"
+
+// withinRateLimit returns true if we can reply in the chat, and to the
+// sender if they asked for it. Users over their limit are told to calm down
+// once, if the chat wants so.
+func (h *Handler) withinRateLimit(asked bool) bool {
+	chatID := h.update.Message.Chat.ID
+	rl := h.settings.RateLimit
+
+	// unprompted replies only count against the chat
+	var userID int
+	if asked {
+		userID = h.update.Message.From.ID
+	}
+	allowed, userLimited, first := h.nocino.Limiter.Allow(chatID, userID, rl)
+	switch {
+	case allowed:
+		return true
+	case !userLimited:
+		h.log.Infof("Chat over rate limit, ignoring: '%s'", h.update.Message.Text)
+		return false
+	}
+
+	h.log.Infof("User over rate limit, ignoring: '%s'", h.update.Message.Text)
+	if first && rl.CalmDown {
+		msg := tgbotapi.NewMessage(chatID, "Calm down, I need a break")
+		msg.ReplyToMessageID = h.update.Message.MessageID
+		if _, err := h.nocino.Outbox.Send(chatID, msg); err != nil {
+			h.log.Errorf("Cannot send calm down message: '%s'", err)
+		}
+	}
+	return false
+}
+
+func (h *Handler) cmdRateLimit(args string) string {
+	chatID := h.update.Message.Chat.ID
+	settings, err := h.nocino.Settings(chatID)
+	if err != nil {
+		h.log.Errorf("Cannot load chat settings: '%s'", err)
+		return "Cannot load the settings of this chat right now"
+	}
+	rl := &settings.RateLimit
+
+	fields := strings.Fields(strings.ToLower(args))
+	switch {
+	case len(fields) == 0:
+		return formatRateLimit(*rl)
+	case len(fields) == 1 && fields[0] == "reset":
+		*rl = h.nocino.Defaults.RateLimit
+	case len(fields) == 2 && fields[0] == "calmdown" && (fields[1] == "on" || fields[1] == "off"):
+		rl.CalmDown = fields[1] == "on"
+	case (len(fields) == 2 || len(fields) == 3) && (fields[0] == "chat" || fields[0] == "user"):
+		rate, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil || rate < 0 {
+			return rateLimitUsage
+		}
+		burst := 1
+		if len(fields) == 3 {
+			if burst, err = strconv.Atoi(fields[2]); err != nil || burst < 1 {
+				return rateLimitUsage
+			}
+		}
+		if fields[0] == "chat" {
+			rl.ChatRate, rl.ChatBurst = rate, burst
+		} else {
+			rl.UserRate, rl.UserBurst = rate, burst
+		}
+	default:
+		return rateLimitUsage
+	}
+
+	if err := h.nocino.SetSettings(chatID, &settings); err != nil {
+		h.log.Errorf("Cannot save chat settings: '%s'", err)
+		return "Cannot save the settings of this chat right now"
+	}
+	h.log.Infof("Rate limits of chat %d changed to %+v", chatID, *rl)
+	return formatRateLimit(*rl)
+}
+
+func formatRateLimit(rl nocino.RateLimit) string {
+	limit := func(rate float64, burst int) string {
+		if rate <= 0 {
+			return "unlimited"
+		}
+		return fmt.Sprintf("%s replies a minute, %d in a burst", strconv.FormatFloat(rate, 'f', -1, 64), burst)
+	}
+	return fmt.Sprintf("Chat: %s\nEach user: %s\nCalm down message: %s",
+		limit(rl.ChatRate, rl.ChatBurst), limit(rl.UserRate, rl.UserBurst), onOff(rl.CalmDown))
+}
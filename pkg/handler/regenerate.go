@@ -0,0 +1,109 @@
+package handler
+
+import (
+	"time"
+
+	"github.com/frapposelli/nocino/pkg/nocino"
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+func init() {
+	callbacks["reply"] = (*Handler).replyCallback
+}
+
+// replyKeyboard returns the buttons under generated replies. Votes are only
+// offered when they have an effect, with weighted generation.
+func replyKeyboard(votes bool) tgbotapi.InlineKeyboardMarkup {
+	var row []tgbotapi.InlineKeyboardButton
+	if votes {
+		row = append(row,
+			tgbotapi.NewInlineKeyboardButtonData("👍", callbackData("reply", "up")),
+			tgbotapi.NewInlineKeyboardButtonData("👎", callbackData("reply", "down")),
+		)
+	}
+	row = append(row,
+		tgbotapi.NewInlineKeyboardButtonData("🔄", callbackData("reply", "regen")),
+		tgbotapi.NewInlineKeyboardButtonData("🗑", callbackData("reply", "delete")),
+	)
+	return tgbotapi.NewInlineKeyboardMarkup(row)
+}
+
+// replyCallback rates, regenerates or deletes the reply whose button was
+// pressed.
+func (h *Handler) replyCallback(data string) string {
+	msg := h.update.CallbackQuery.Message
+	if msg == nil {
+		return ""
+	}
+	reply := h.nocino.Replies.Get(msg.Chat.ID, msg.MessageID)
+
+	switch data {
+	case "up":
+		text, _ := h.feedback(msg.Chat.ID, msg.MessageID, 1)
+		return text
+	case "down":
+		text, _ := h.feedback(msg.Chat.ID, msg.MessageID, -1)
+		return text
+	case "regen":
+		return h.regenerate(msg, reply)
+	case "delete":
+		// replies we forgot can only be deleted by admins
+		asker := reply != nil && reply.AskerID == h.from().ID
+		if !asker && !h.isTrusted() && !h.isChatAdmin() {
+			return "Only who asked or chat admins can delete this"
+		}
+		if _, err := h.nocino.API.DeleteMessage(tgbotapi.DeleteMessageConfig{ChatID: msg.Chat.ID, MessageID: msg.MessageID}); err != nil {
+			h.log.Errorf("Cannot delete reply: '%s'", err)
+			return "Cannot delete this right now"
+		}
+		h.log.Infof("Deleted reply %d in chat %d", msg.MessageID, msg.Chat.ID)
+	}
+	return ""
+}
+
+// regenerate replaces the text of msg with a new one, generated from the
+// same seed.
+func (h *Handler) regenerate(msg *tgbotapi.Message, reply *nocino.Reply) string {
+	if reply == nil || reply.Trace == nil {
+		return "I don't remember how I came up with that"
+	}
+	settings, err := h.nocino.Settings(msg.Chat.ID)
+	if err != nil {
+		h.log.Errorf("Cannot load chat settings, using defaults: '%s'", err)
+	}
+	h.settings = settings
+
+	if h.settings.QuietHours.Contains(time.Now()) {
+		h.log.Infof("Not regenerating during quiet hours (%s)", h.settings.QuietHours)
+		return "I'm resting now, try later"
+	}
+	if allowed, _, _ := h.nocino.Limiter.Allow(msg.Chat.ID, h.from().ID, h.settings.RateLimit); !allowed {
+		h.log.Infof("Over rate limit, not regenerating reply %d", msg.MessageID)
+		return "Calm down, I need a break"
+	}
+
+	text, trace, elapsed := h.markov.GenerateChainTrace(msg.Chat.ID, h.settings.ReplyLength, reply.Trace.Seed)
+	h.log.WithField("elapsed", elapsed.String()).Infof("Regenerating reply: '%s'", text)
+	if text == "" || text == msg.Text {
+		return "Cannot come up with anything different"
+	}
+	if !h.sendable(msg.Chat.ID, text) {
+		return "Cannot come up with anything better"
+	}
+
+	edit := tgbotapi.NewEditMessageText(msg.Chat.ID, msg.MessageID, text)
+	keyboard := replyKeyboard(h.markov.Weighted())
+	edit.ReplyMarkup = &keyboard
+	if _, err := h.nocino.Outbox.Send(msg.Chat.ID, edit); err != nil {
+		h.log.Errorf("Cannot edit reply: '%s'", err)
+		return "Cannot change this right now"
+	}
+	h.nocino.Replies.Add(&nocino.Reply{
+		ChatID:    reply.ChatID,
+		MessageID: reply.MessageID,
+		AskerID:   reply.AskerID,
+		Trace:     trace,
+		Sent:      time.Now(),
+	})
+	return ""
+}
@@ -0,0 +1,248 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"unicode/utf16"
+
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+// Permission is the privilege needed to run a command.
+type Permission int
+
+const (
+	// PermAnyone lets everyone run a command.
+	PermAnyone Permission = iota
+	// PermChatAdmin restricts a command to the administrators of the chat
+	// it is sent in, and to trusted users.
+	PermChatAdmin
+	// PermTrusted restricts a command to trusted users.
+	PermTrusted
+)
+
+func (p Permission) String() string {
+	switch p {
+	case PermChatAdmin:
+		return "chat admins"
+	case PermTrusted:
+		return "trusted users"
+	}
+	return "anyone"
+}
+
+// Command is a bot command.
+type Command struct {
+	// Name is the command without the leading slash.
+	Name        string
+	Args        string
+	Description string
+	Permission  Permission
+	// PrivateOnly commands are only accepted in private chats.
+	PrivateOnly bool
+	// Run runs the command with the text following it and returns the reply
+	// to send, if any.
+	Run func(h *Handler, args string) string
+}
+
+// Registry routes commands to their handlers.
+type Registry struct {
+	mutex    sync.RWMutex
+	commands map[string]*Command
+	order    []string
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		commands: make(map[string]*Command),
+	}
+}
+
+// registry holds the commands understood by the bot.
+var registry = NewRegistry()
+
+// Register adds cmd to the registry, replacing any command with the same
+// name.
+func (r *Registry) Register(cmd *Command) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, ok := r.commands[cmd.Name]; !ok {
+		r.order = append(r.order, cmd.Name)
+	}
+	r.commands[cmd.Name] = cmd
+}
+
+// Lookup returns the command called name, or nil.
+func (r *Registry) Lookup(name string) *Command {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.commands[strings.ToLower(name)]
+}
+
+// Commands returns the registered commands, in the order they were
+// registered.
+func (r *Registry) Commands() []*Command {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	cmds := make([]*Command, 0, len(r.order))
+	for _, name := range r.order {
+		cmds = append(cmds, r.commands[name])
+	}
+	return cmds
+}
+
+// SetMyCommands publishes the commands that are not restricted to trusted
+// users to Telegram, so clients can suggest them.
+func SetMyCommands(api *tgbotapi.BotAPI) error {
+	type botCommand struct {
+		Command     string `json:"command"`
+		Description string `json:"description"`
+	}
+	var list []botCommand
+	for _, cmd := range registry.Commands() {
+		if cmd.Permission == PermTrusted {
+			continue
+		}
+		list = append(list, botCommand{Command: cmd.Name, Description: cmd.Description})
+	}
+
+	buf, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	_, err = api.MakeRequest("setMyCommands", url.Values{"commands": {string(buf)}})
+	return err
+}
+
+// parseCommand parses a message starting with a bot_command entity into the
+// command name, the bot it is addressed to if any, and its arguments.
+func parseCommand(m *tgbotapi.Message) (name string, bot string, args string, ok bool) {
+	if m.Entities == nil || len(*m.Entities) == 0 {
+		return "", "", "", false
+	}
+	entity := (*m.Entities)[0]
+	if entity.Type != "bot_command" || entity.Offset != 0 {
+		return "", "", "", false
+	}
+
+	text := entityUnits(m.Text)
+	if entity.Length > len(text) || entity.Length < 2 {
+		return "", "", "", false
+	}
+	cmd := string(utf16.Decode(text[1:entity.Length]))
+	args = strings.TrimSpace(string(utf16.Decode(text[entity.Length:])))
+
+	name = cmd
+	if at := strings.Index(cmd, "@"); at != -1 {
+		name, bot = cmd[:at], cmd[at+1:]
+	}
+	return strings.ToLower(name), bot, args, true
+}
+
+// allowed returns true if the sender of the message may run cmd.
+func (h *Handler) allowed(cmd *Command) bool {
+	if cmd.PrivateOnly && !h.chat().IsPrivate() {
+		return false
+	}
+	switch cmd.Permission {
+	case PermTrusted:
+		return h.isTrusted()
+	case PermChatAdmin:
+		return h.isTrusted() || h.isChatAdmin()
+	}
+	return true
+}
+
+func (h *Handler) isTrusted() bool {
+	return h.nocino.TrustedMap[h.from().ID]
+}
+
+// isChatAdmin returns true if the sender administers the chat the update
+// comes from, according to the cached administrators of the chat. Everyone
+// administers their private chat with us.
+func (h *Handler) isChatAdmin() bool {
+	if h.chatAdmin != nil {
+		return *h.chatAdmin
+	}
+
+	admin := false
+	chat := h.chat()
+	if chat == nil {
+		return false
+	}
+	if chat.IsPrivate() || chat.AllMembersAreAdmins {
+		admin = true
+	} else {
+		var err error
+		if admin, err = h.nocino.Admins.IsAdmin(chat.ID, h.from().ID); err != nil {
+			h.log.Errorf("Cannot get chat administrators: '%s'", err)
+			return false
+		}
+	}
+	h.chatAdmin = &admin
+	return admin
+}
+
+// dispatchCommand runs the command in the message, if it is one for us. It
+// returns false if the message is not a command for us, and should be
+// handled as a regular message.
+func (h *Handler) dispatchCommand() (bool, error) {
+	name, bot, args, ok := parseCommand(h.update.Message)
+	if !ok {
+		return false, nil
+	}
+	// ignore commands addressed to other bots
+	if bot != "" && !strings.EqualFold("@"+bot, h.nocino.BotUsername) {
+		return false, nil
+	}
+
+	var reply string
+	cmd := registry.Lookup(name)
+	switch {
+	case cmd == nil && h.update.Message.Chat.IsPrivate():
+		reply = fmt.Sprintf("Unknown command '/%s', see /help", name)
+	case cmd == nil:
+		// in groups, it might be meant for some other bot
+		return false, nil
+	case !h.allowed(cmd):
+		h.log.Warnf("Unauthorized command '/%s' with arguments '%s'", name, args)
+		reply = fmt.Sprintf("You are not allowed to run '/%s'", name)
+	default:
+		h.log.Infof("Running command '/%s' with arguments '%s'", name, args)
+		reply = cmd.Run(h, args)
+	}
+	if reply == "" {
+		return true, nil
+	}
+
+	msg := tgbotapi.NewMessage(h.update.Message.Chat.ID, reply)
+	msg.ReplyToMessageID = h.update.Message.MessageID
+	_, err := h.nocino.Outbox.Send(h.update.Message.Chat.ID, msg)
+	return true, err
+}
+
+// cmdHelp lists the commands the sender can run here.
+func (h *Handler) cmdHelp(args string) string {
+	var b strings.Builder
+	b.WriteString("Mention me or reply to my messages to talk to me.\n\n")
+	for _, cmd := range registry.Commands() {
+		if !h.allowed(cmd) {
+			continue
+		}
+		usage := fmt.Sprintf("/%s", cmd.Name)
+		if cmd.Args != "" {
+			usage = fmt.Sprintf("%s %s", usage, cmd.Args)
+		}
+		fmt.Fprintf(&b, "%s - %s", usage, cmd.Description)
+		if cmd.Permission != PermAnyone {
+			fmt.Fprintf(&b, " (%s)", cmd.Permission)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
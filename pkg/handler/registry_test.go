@@ -0,0 +1,77 @@
+package handler
+
+import (
+	"testing"
+
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		entities []tgbotapi.MessageEntity
+		cmd      string
+		bot      string
+		args     string
+		ok       bool
+	}{
+		{
+			name:     "plain",
+			text:     "/stats",
+			entities: []tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: 6}},
+			cmd:      "stats",
+			ok:       true,
+		},
+		{
+			name:     "addressed with arguments",
+			text:     "/Why@nocinobot the cat",
+			entities: []tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: 14}},
+			cmd:      "why",
+			bot:      "nocinobot",
+			args:     "the cat",
+			ok:       true,
+		},
+		{
+			// the emojis take two UTF-16 code units each
+			name:     "emoji arguments",
+			text:     "/block 😀😀 global",
+			entities: []tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: 6}},
+			cmd:      "block",
+			args:     "😀😀 global",
+			ok:       true,
+		},
+		{
+			name:     "not at the start",
+			text:     "😀 /stats",
+			entities: []tgbotapi.MessageEntity{{Type: "bot_command", Offset: 3, Length: 6}},
+		},
+		{
+			name:     "other entity",
+			text:     "@nocinobot /stats",
+			entities: []tgbotapi.MessageEntity{{Type: "mention", Offset: 0, Length: 10}},
+		},
+		{
+			name:     "entity past the end",
+			text:     "/st",
+			entities: []tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: 6}},
+		},
+		{
+			name: "no entities",
+			text: "/stats",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &tgbotapi.Message{Text: tt.text}
+			if tt.entities != nil {
+				m.Entities = &tt.entities
+			}
+			cmd, bot, args, ok := parseCommand(m)
+			if cmd != tt.cmd || bot != tt.bot || args != tt.args || ok != tt.ok {
+				t.Errorf("parseCommand() = '%s', '%s', '%s', %t, want '%s', '%s', '%s', %t",
+					cmd, bot, args, ok, tt.cmd, tt.bot, tt.args, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package handler
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/frapposelli/nocino/pkg/nocino"
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+const (
+	gifRatioStep    = 0.1
+	replyLengthStep = 5
+	maxReplyLength  = 100
+)
+
+// interjectSteps are the interjection probabilities the settings menu steps
+// through.
+var interjectSteps = []float64{0, 0.01, 0.02, 0.05, 0.1}
+
+func init() {
+	callbacks["settings"] = (*Handler).settingsCallback
+}
+
+func (h *Handler) cmdSettings(args string) string {
+	chatID := h.update.Message.Chat.ID
+	settings, err := h.nocino.Settings(chatID)
+	if err != nil {
+		h.log.Errorf("Cannot load chat settings: '%s'", err)
+		return "Cannot load the settings of this chat right now"
+	}
+
+	msg := tgbotapi.NewMessage(chatID, formatSettings(settings))
+	msg.ReplyMarkup = settingsKeyboard(settings)
+	if _, err := h.nocino.Outbox.Send(chatID, msg); err != nil {
+		h.log.Errorf("Cannot send settings menu: '%s'", err)
+	}
+	return ""
+}
+
+// settingsCallback changes the setting of the button pressed in the menu sent
+// by /settings, and updates the menu.
+func (h *Handler) settingsCallback(data string) string {
+	menu := h.update.CallbackQuery.Message
+	if menu == nil {
+		return ""
+	}
+	if !h.isTrusted() && !h.isChatAdmin() {
+		h.log.Warnf("Unauthorized settings change '%s'", data)
+		return "Only chat admins can change settings"
+	}
+
+	settings, err := h.nocino.Settings(menu.Chat.ID)
+	if err != nil {
+		h.log.Errorf("Cannot load chat settings: '%s'", err)
+		return "Cannot load the settings of this chat right now"
+	}
+	prev := formatSettings(settings)
+
+	switch data {
+	case "gif-":
+		settings.GIFRatio = math.Max(0, math.Round((settings.GIFRatio-gifRatioStep)*10)/10)
+	case "gif+":
+		settings.GIFRatio = math.Min(1, math.Round((settings.GIFRatio+gifRatioStep)*10)/10)
+	case "len-":
+		if settings.ReplyLength > replyLengthStep {
+			settings.ReplyLength -= replyLengthStep
+		}
+	case "len+":
+		if settings.ReplyLength+replyLengthStep <= maxReplyLength {
+			settings.ReplyLength += replyLengthStep
+		}
+	case "learn":
+		settings.Learning = !settings.Learning
+	case "interject":
+		settings.Interjection.Probability = nextInterjectStep(settings.Interjection.Probability)
+	case "reset":
+		settings = h.nocino.Defaults
+	case "close":
+		edit := tgbotapi.NewEditMessageText(menu.Chat.ID, menu.MessageID, prev)
+		if _, err := h.nocino.Outbox.Send(menu.Chat.ID, edit); err != nil {
+			h.log.Errorf("Cannot close settings menu: '%s'", err)
+		}
+		return ""
+	default:
+		return ""
+	}
+
+	text := formatSettings(settings)
+	// reset also clears the overrides the menu does not show
+	if data != "reset" && text == prev {
+		return "Nothing to change"
+	}
+	if data == "reset" {
+		err = h.nocino.SetSettings(menu.Chat.ID, nil)
+	} else {
+		err = h.nocino.SetSettings(menu.Chat.ID, &settings)
+	}
+	if err != nil {
+		h.log.Errorf("Cannot save chat settings: '%s'", err)
+		return "Cannot save the settings of this chat right now"
+	}
+	h.log.Infof("Settings of chat %d changed to %+v", menu.Chat.ID, settings)
+	if text == prev {
+		// Telegram refuses edits that change nothing
+		return "Settings reset"
+	}
+
+	edit := tgbotapi.NewEditMessageText(menu.Chat.ID, menu.MessageID, text)
+	keyboard := settingsKeyboard(settings)
+	edit.ReplyMarkup = &keyboard
+	if _, err := h.nocino.Outbox.Send(menu.Chat.ID, edit); err != nil {
+		h.log.Errorf("Cannot update settings menu: '%s'", err)
+	}
+	return ""
+}
+
+// nextInterjectStep returns the interjection probability following p in
+// interjectSteps, going back to off after the last one.
+func nextInterjectStep(p float64) float64 {
+	for _, step := range interjectSteps {
+		if step > p {
+			return step
+		}
+	}
+	return interjectSteps[0]
+}
+
+func formatSettings(s nocino.ChatSettings) string {
+	var b strings.Builder
+	b.WriteString("Settings of this chat\n\n")
+	fmt.Fprintf(&b, "Reply length: %d words\n", s.ReplyLength)
+	fmt.Fprintf(&b, "GIFs: %s of replies\n", formatProbability(s.GIFRatio))
+	fmt.Fprintf(&b, "Learning: %s\n", onOff(s.Learning))
+	fmt.Fprintf(&b, "%s\n", formatInterjection(s.Interjection))
+	if s.Language != "" {
+		fmt.Fprintf(&b, "Language: %s\n", s.Language)
+	}
+	if len(s.ContentFilters) > 0 {
+		fmt.Fprintf(&b, "Content filters: %d\n", len(s.ContentFilters))
+	}
+	fmt.Fprintf(&b, "Quiet hours: %s\n", s.QuietHours)
+	return b.String()
+}
+
+func settingsKeyboard(s nocino.ChatSettings) tgbotapi.InlineKeyboardMarkup {
+	button := func(text string, data string) tgbotapi.InlineKeyboardButton {
+		return tgbotapi.NewInlineKeyboardButtonData(text, callbackData("settings", data))
+	}
+	interject := "Interjections: off"
+	if s.Interjection.Probability > 0 {
+		interject = fmt.Sprintf("Interjections: %s", formatProbability(s.Interjection.Probability))
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			button("Shorter", "len-"),
+			button(fmt.Sprintf("%d words", s.ReplyLength), "noop"),
+			button("Longer", "len+"),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			button("Fewer GIFs", "gif-"),
+			button(fmt.Sprintf("%s GIFs", formatProbability(s.GIFRatio)), "noop"),
+			button("More GIFs", "gif+"),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			button(fmt.Sprintf("Learning: %s", onOff(s.Learning)), "learn"),
+			button(interject, "interject"),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			button("Reset", "reset"),
+			button("Close", "close"),
+		),
+	)
+}
+
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
+
+func (h *Handler) cmdLanguage(args string) string {
+	chatID := h.update.Message.Chat.ID
+	settings, err := h.nocino.Settings(chatID)
+	if err != nil {
+		h.log.Errorf("Cannot load chat settings: '%s'", err)
+		return "Cannot load the settings of this chat right now"
+	}
+
+	lang := strings.ToLower(strings.TrimSpace(args))
+	switch {
+	case lang == "":
+		if settings.Language == "" {
+			return "I don't know the language spoken here"
+		}
+		return fmt.Sprintf("Language: %s", settings.Language)
+	case lang == "reset":
+		settings.Language = h.nocino.Defaults.Language
+	case len(lang) == 2 && strings.Trim(lang, "abcdefghijklmnopqrstuvwxyz") == "":
+		settings.Language = lang
+	default:
+		return "Usage: /language [<ISO 639-1 code>|reset]"
+	}
+
+	if err := h.nocino.SetSettings(chatID, &settings); err != nil {
+		h.log.Errorf("Cannot save chat settings: '%s'", err)
+		return "Cannot save the settings of this chat right now"
+	}
+	h.log.Infof("Language of chat %d changed to '%s'", chatID, settings.Language)
+	if settings.Language == "" {
+		return "I don't know the language spoken here"
+	}
+	return fmt.Sprintf("Language: %s", settings.Language)
+}
@@ -0,0 +1,170 @@
+package handler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/frapposelli/nocino/pkg/nocino"
+)
+
+const addTriggerUsage = "Usage: /addtrigger <word or /regex/> [probability] [| reply]"
+
+// matchTrigger returns the first trigger of the chat matching the message
+// that wins its roll, or nil.
+func (h *Handler) matchTrigger() *nocino.Trigger {
+	if h.update.Message.Text == "" {
+		return nil
+	}
+	triggers, err := h.nocino.Triggers(h.update.Message.Chat.ID)
+	if err != nil {
+		h.log.Errorf("Cannot load triggers: '%s'", err)
+		return nil
+	}
+	for i := range triggers {
+		t := &triggers[i]
+		if !t.Match(h.update.Message.Text) {
+			continue
+		}
+		if h.rand.Float64() >= t.Probability {
+			h.log.Debugf("Trigger '%s' matched but lost the roll", t.Pattern)
+			continue
+		}
+		return t
+	}
+	return nil
+}
+
+func (h *Handler) cmdTriggers(args string) string {
+	triggers, err := h.nocino.Triggers(h.update.Message.Chat.ID)
+	if err != nil {
+		h.log.Errorf("Cannot load triggers: '%s'", err)
+		return "Cannot load the triggers of this chat right now"
+	}
+	if len(triggers) == 0 {
+		return "No triggers here, add some with /addtrigger"
+	}
+
+	var b strings.Builder
+	for i, t := range triggers {
+		fmt.Fprintf(&b, "%d. %s", i+1, formatTrigger(t))
+		if t.Probability < 1 {
+			fmt.Fprintf(&b, " (%s)", formatProbability(t.Probability))
+		}
+		if t.Reply != "" {
+			fmt.Fprintf(&b, " → %s", t.Reply)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func (h *Handler) cmdAddTrigger(args string) string {
+	t, err := parseTrigger(args)
+	if err != nil {
+		return addTriggerUsage
+	}
+	if _, err := t.Compile(); err != nil {
+		return fmt.Sprintf("Invalid regular expression: %s", err)
+	}
+
+	chatID := h.update.Message.Chat.ID
+	triggers, err := h.nocino.Triggers(chatID)
+	if err != nil {
+		h.log.Errorf("Cannot load triggers: '%s'", err)
+		return "Cannot load the triggers of this chat right now"
+	}
+	for i := range triggers {
+		if triggers[i].Pattern == t.Pattern && triggers[i].Regex == t.Regex {
+			triggers = append(triggers[:i], triggers[i+1:]...)
+			break
+		}
+	}
+	triggers = append(triggers, t)
+	if err := h.nocino.SetTriggers(chatID, triggers); err != nil {
+		h.log.Errorf("Cannot save triggers: '%s'", err)
+		return fmt.Sprintf("Cannot save the trigger: %s", err)
+	}
+	h.log.Infof("Added trigger %s to chat %d", formatTrigger(t), chatID)
+	return fmt.Sprintf("Added trigger %s", formatTrigger(t))
+}
+
+func (h *Handler) cmdDelTrigger(args string) string {
+	args = strings.TrimSpace(args)
+	if args == "" {
+		return "Usage: /deltrigger <number or pattern>, see /triggers"
+	}
+
+	chatID := h.update.Message.Chat.ID
+	triggers, err := h.nocino.Triggers(chatID)
+	if err != nil {
+		h.log.Errorf("Cannot load triggers: '%s'", err)
+		return "Cannot load the triggers of this chat right now"
+	}
+	i := -1
+	if n, err := strconv.Atoi(args); err == nil && n >= 1 && n <= len(triggers) {
+		i = n - 1
+	} else {
+		for j, t := range triggers {
+			if formatTrigger(t) == args || t.Pattern == args {
+				i = j
+				break
+			}
+		}
+	}
+	if i == -1 {
+		return fmt.Sprintf("No trigger '%s', see /triggers", args)
+	}
+
+	t := triggers[i]
+	triggers = append(triggers[:i], triggers[i+1:]...)
+	if err := h.nocino.SetTriggers(chatID, triggers); err != nil {
+		h.log.Errorf("Cannot save triggers: '%s'", err)
+		return fmt.Sprintf("Cannot remove the trigger: %s", err)
+	}
+	h.log.Infof("Removed trigger %s from chat %d", formatTrigger(t), chatID)
+	return fmt.Sprintf("Removed trigger %s", formatTrigger(t))
+}
+
+// parseTrigger parses the arguments of /addtrigger: a word or a regular
+// expression between slashes, an optional probability and an optional fixed
+// reply after a pipe.
+func parseTrigger(args string) (nocino.Trigger, error) {
+	t := nocino.Trigger{Probability: 1}
+	if i := strings.Index(args, "|"); i != -1 {
+		t.Reply = strings.TrimSpace(args[i+1:])
+		args = args[:i]
+	}
+	args = strings.TrimSpace(args)
+
+	var rest string
+	if end := strings.LastIndex(args, "/"); strings.HasPrefix(args, "/") && end > 1 {
+		t.Pattern, t.Regex = args[1:end], true
+		rest = args[end+1:]
+	} else {
+		fields := strings.SplitN(args, " ", 2)
+		t.Pattern = fields[0]
+		if len(fields) == 2 {
+			rest = fields[1]
+		}
+	}
+	if t.Pattern == "" {
+		return t, fmt.Errorf("missing pattern")
+	}
+
+	if rest = strings.TrimSpace(rest); rest != "" {
+		p, err := parseProbability(rest)
+		if err != nil {
+			return t, err
+		}
+		t.Probability = p
+	}
+	return t, nil
+}
+
+func formatTrigger(t nocino.Trigger) string {
+	if t.Regex {
+		return "/" + t.Pattern + "/"
+	}
+	return t.Pattern
+}
@@ -0,0 +1,153 @@
+package markov
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const backupTimeFormat = "20060102T150405"
+
+// Backup writes a consistent snapshot of the state DB into dir, optionally
+// gzip-compressed, and returns the path of the new backup and its size.
+func (c *Chain) Backup(dir string, compress bool) (string, int64, error) {
+	c.dbMutex.RLock()
+	defer c.dbMutex.RUnlock()
+	return backup(c.db, c.path, dir, compress)
+}
+
+// backup writes a snapshot of db, opened from path, into dir.
+func backup(db *bolt.DB, path string, dir string, compress bool) (string, int64, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", 0, err
+	}
+
+	name := fmt.Sprintf("%s-%s.db", backupPrefix(path), time.Now().UTC().Format(backupTimeFormat))
+	if compress {
+		name = fmt.Sprintf("%s.gz", name)
+	}
+	dst := filepath.Join(dir, name)
+
+	// write to a temporary file first, so a half-written backup never looks
+	// like a valid one to the rotation or to a restore.
+	tmp, err := ioutil.TempFile(dir, ".backup-")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	var w io.Writer = tmp
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(tmp)
+		w = gz
+	}
+
+	err = db.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(w)
+		return err
+	})
+	if err == nil && gz != nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", 0, err
+	}
+
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return "", 0, err
+	}
+
+	fi, err := os.Stat(dst)
+	if err != nil {
+		return "", 0, err
+	}
+	return dst, fi.Size(), nil
+}
+
+// Backups returns the backups of the state DB found in dir, oldest first.
+func (c *Chain) Backups(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := fmt.Sprintf("%s-", backupPrefix(c.path))
+	var backups []string
+	for _, f := range files {
+		if f.IsDir() || !strings.HasPrefix(f.Name(), prefix) {
+			continue
+		}
+		if !strings.HasSuffix(f.Name(), ".db") && !strings.HasSuffix(f.Name(), ".db.gz") {
+			continue
+		}
+		backups = append(backups, f.Name())
+	}
+	// timestamps are fixed width, so lexical order is chronological order
+	sort.Strings(backups)
+	return backups, nil
+}
+
+// RotateBackups removes all but the newest keep backups from dir.
+func (c *Chain) RotateBackups(dir string, keep int) error {
+	backups, err := c.Backups(dir)
+	if err != nil {
+		return err
+	}
+	if keep < 1 || len(backups) <= keep {
+		return nil
+	}
+
+	for _, b := range backups[:len(backups)-keep] {
+		c.log.Infof("Removing old backup '%s'", b)
+		if err := os.Remove(filepath.Join(dir, b)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunBackupTicker takes a backup of the state DB every interval, keeping
+// only the newest keep backups in dir. An interval of 0 or less disables
+// backups.
+func (c *Chain) RunBackupTicker(interval time.Duration, dir string, keep int, compress bool) {
+	if interval <= 0 {
+		c.log.Warnf("Backup interval is %s, scheduled backups are disabled", interval)
+		return
+	}
+	ticker := time.NewTicker(interval)
+	go func() {
+		for range ticker.C {
+			t := time.Now()
+			path, size, err := c.Backup(dir, compress)
+			if err != nil {
+				c.log.Errorf("backup of state DB failed with: '%s'", err)
+				continue
+			}
+			c.log.WithField("elapsed", time.Since(t).String()).Infof("Backed up state to '%s' (%d bytes)", path, size)
+
+			if err := c.RotateBackups(dir, keep); err != nil {
+				c.log.Errorf("rotation of backups failed with: '%s'", err)
+			}
+		}
+	}()
+}
+
+// backupPrefix returns the name backups of the state file at path start with.
+func backupPrefix(path string) string {
+	return strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+}
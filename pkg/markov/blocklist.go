@@ -0,0 +1,167 @@
+package markov
+
+import (
+	"encoding/json"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Blocklist tells which words must never be learned nor said.
+type Blocklist interface {
+	// Blocked returns true if word is blocked in chatID. A chatID of 0 only
+	// looks at the words blocked everywhere.
+	Blocked(chatID int64, word string) bool
+}
+
+// SetBlocklist makes the chain leave out the words blocked by b when
+// learning and generating.
+func (c *Chain) SetBlocklist(b Blocklist) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.blocklist = b
+}
+
+func (c *Chain) blocked(chatID int64, word string) bool {
+	return c.blocklist != nil && c.blocklist.Blocked(chatID, word)
+}
+
+// fragments splits in into the runs of words between blocked words.
+func (c *Chain) fragments(chatID int64, in string) [][]string {
+	var fragments [][]string
+	var fragment []string
+	for _, w := range strings.Fields(in) {
+		if !c.blocked(chatID, w) {
+			fragment = append(fragment, w)
+			continue
+		}
+		c.log.Debugf("not learning blocked word '%s'", w)
+		if len(fragment) > 0 {
+			fragments = append(fragments, fragment)
+		}
+		fragment = nil
+	}
+	if len(fragment) > 0 {
+		fragments = append(fragments, fragment)
+	}
+	return fragments
+}
+
+// Purge removes the words matched by blocked from the chain, along with the
+// prefixes containing them, and returns the number of transitions removed.
+func (c *Chain) Purge(blocked func(word string) bool) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var removed int
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("Chain"))
+		changes := make(map[string][]byte)
+		err := b.ForEach(func(k, v []byte) error {
+			s, err := decodeSuffixes(v)
+			if err != nil {
+				return nil
+			}
+			for _, w := range strings.Split(string(k), " ") {
+				if w != "" && blocked(w) {
+					removed += len(s)
+					changes[string(k)] = nil
+					return nil
+				}
+			}
+
+			var changed bool
+			for w := range s {
+				if blocked(w) {
+					delete(s, w)
+					removed++
+					changed = true
+				}
+			}
+			if !changed {
+				return nil
+			}
+			if len(s) == 0 {
+				changes[string(k)] = nil
+				return nil
+			}
+			buf, err := json.Marshal(s)
+			if err != nil {
+				return err
+			}
+			changes[string(k)] = buf
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// drop the messages with the word from the corpus too, or it would be
+		// learned again when they are edited
+		if err := scrubCorpus(tx.Bucket([]byte("Corpus")), blocked); err != nil {
+			return err
+		}
+		if len(changes) == 0 {
+			return nil
+		}
+
+		for k, v := range changes {
+			if v == nil {
+				err = b.Delete([]byte(k))
+			} else {
+				err = b.Put([]byte(k), v)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if err := rebuildChain(tx); err != nil {
+			return err
+		}
+		if err := pruneFeedback(tx); err != nil {
+			return err
+		}
+		for _, name := range []string{"Stats", "Words"} {
+			if err := tx.DeleteBucket([]byte(name)); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+		}
+		return buildStats(tx)
+	})
+	if err != nil {
+		c.log.Errorf("error when purging blocked words: '%s'", err)
+		return 0, err
+	}
+	c.log.Infof("Purged %d transitions of blocked words", removed)
+	return removed, nil
+}
+
+// scrubCorpus drops the messages with words matched by blocked from the
+// corpus. Purging changed what they taught the chain, so they could no longer
+// be unlearned exactly when edited.
+func scrubCorpus(b *bolt.Bucket, blocked func(word string) bool) error {
+	var keys [][]byte
+	err := b.ForEach(func(k, v []byte) error {
+		var e corpusEntry
+		if err := json.Unmarshal(v, &e); err != nil {
+			// left for Check
+			return nil
+		}
+		for _, w := range strings.Fields(e.Learned) {
+			if blocked(w) {
+				keys = append(keys, append([]byte(nil), k...))
+				return nil
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
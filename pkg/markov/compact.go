@@ -0,0 +1,172 @@
+package markov
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// compactTxMaxSize is the amount of data copied per write transaction while
+// compacting, to keep memory usage bounded on large state files.
+const compactTxMaxSize = 64 * 1024 * 1024
+
+// Compact copies the state DB into a fresh file, dropping the free pages bolt
+// never gives back, and swaps it in. It returns the size of the state file
+// before and after. Chain operations block until it is done.
+func (c *Chain) Compact() (int64, int64, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	before, err := fileSize(c.path)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(c.path), ".compact-")
+	if err != nil {
+		return 0, 0, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	dst, err := bolt.Open(tmp.Name(), 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return 0, 0, err
+	}
+	c.dbMutex.RLock()
+	err = compactDB(dst, c.db)
+	c.dbMutex.RUnlock()
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	old := fmt.Sprintf("%s.compact", c.path)
+	if err := c.swapLocked(tmp.Name(), old); err != nil {
+		return 0, 0, err
+	}
+	if err := os.Remove(old); err != nil {
+		c.log.Errorf("cannot remove pre-compaction state '%s': '%s'", old, err)
+	}
+
+	after, err := fileSize(c.path)
+	if err != nil {
+		return 0, 0, err
+	}
+	return before, after, nil
+}
+
+// RunCompactScheduler compacts the state DB every day at the time of day of
+// at, so it happens in a quiet maintenance window.
+func (c *Chain) RunCompactScheduler(at time.Time) {
+	go func() {
+		for {
+			now := time.Now()
+			next := time.Date(now.Year(), now.Month(), now.Day(), at.Hour(), at.Minute(), 0, 0, now.Location())
+			if !next.After(now) {
+				next = next.AddDate(0, 0, 1)
+			}
+			c.log.Infof("Next state compaction scheduled at %s", next.Format(time.RFC3339))
+			time.Sleep(time.Until(next))
+
+			t := time.Now()
+			before, after, err := c.Compact()
+			if err != nil {
+				c.log.Errorf("compaction of state DB failed with: '%s'", err)
+				continue
+			}
+			c.log.WithField("elapsed", time.Since(t).String()).Infof("Compacted state from %d bytes to %d bytes", before, after)
+		}
+	}()
+}
+
+// compactDB copies every bucket in src to dst, committing a write
+// transaction every compactTxMaxSize bytes.
+func compactDB(dst, src *bolt.DB) error {
+	var size int64
+	tx, err := dst.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer func() { tx.Rollback() }()
+
+	err = src.View(func(stx *bolt.Tx) error {
+		return stx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			// create the bucket upfront, it might have no keys
+			nb, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+			if err := nb.SetSequence(b.Sequence()); err != nil {
+				return err
+			}
+
+			return walkBucket(b, nil, func(path [][]byte, k, v []byte, seq uint64) error {
+				// commit once we go over the size limit
+				size += int64(len(k) + len(v))
+				if size > compactTxMaxSize {
+					if err := tx.Commit(); err != nil {
+						return err
+					}
+					if tx, err = dst.Begin(true); err != nil {
+						return err
+					}
+					size = 0
+				}
+
+				// walk down to the bucket holding this key, creating it on the way
+				bkt, err := tx.CreateBucketIfNotExists(name)
+				if err != nil {
+					return err
+				}
+				for _, p := range path {
+					if bkt, err = bkt.CreateBucketIfNotExists(p); err != nil {
+						return err
+					}
+				}
+				if v == nil {
+					nb, err := bkt.CreateBucketIfNotExists(k)
+					if err != nil {
+						return err
+					}
+					return nb.SetSequence(seq)
+				}
+				bkt.FillPercent = 1.0
+				return bkt.Put(k, v)
+			})
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// walkBucket calls fn for every key in b and, recursively, in its nested
+// buckets. Nested buckets are reported with a nil value before their keys.
+func walkBucket(b *bolt.Bucket, path [][]byte, fn func(path [][]byte, k, v []byte, seq uint64) error) error {
+	return b.ForEach(func(k, v []byte) error {
+		if v != nil {
+			return fn(path, k, v, 0)
+		}
+		nb := b.Bucket(k)
+		if err := fn(path, k, nil, nb.Sequence()); err != nil {
+			return err
+		}
+		return walkBucket(nb, append(append([][]byte{}, path...), k), fn)
+	})
+}
+
+func fileSize(path string) (int64, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
@@ -0,0 +1,189 @@
+package markov
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// corpusEntry is a message kept in the Corpus bucket, so it can be unlearned
+// when edited.
+type corpusEntry struct {
+	UserID int
+	// Learned is what learn returned for the message.
+	Learned string
+	// Time is when the message was learned, in Unix seconds.
+	Time int64
+}
+
+// corpusKey returns the key of a message in the Corpus bucket.
+func corpusKey(chatID int64, messageID int) []byte {
+	return []byte(strconv.FormatInt(chatID, 10) + ":" + strconv.Itoa(messageID))
+}
+
+func getCorpusEntry(b *bolt.Bucket, key []byte) (*corpusEntry, error) {
+	v := b.Get(key)
+	if v == nil {
+		return nil, nil
+	}
+	var e corpusEntry
+	if err := json.Unmarshal(v, &e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func putCorpusEntry(b *bolt.Bucket, key []byte, e corpusEntry) error {
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, buf)
+}
+
+// AddMessage adds message messageID sent by userID in chatID to the chain,
+// also keeping it in the corpus so it can be edited later.
+func (c *Chain) AddMessage(chatID int64, userID int, messageID int, in string) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		delta := newStatsDelta()
+		learned, err := c.learn(tx, delta, chatID, in)
+		if err != nil {
+			return err
+		}
+		e := corpusEntry{UserID: userID, Learned: learned, Time: time.Now().Unix()}
+		if err := putCorpusEntry(tx.Bucket([]byte("Corpus")), corpusKey(chatID, messageID), e); err != nil {
+			return err
+		}
+		return delta.write(tx, chatID)
+	})
+	if err != nil {
+		c.log.Errorf("error when writing to DB: '%s'", err)
+		return 0, err
+	}
+	return len(in), nil
+}
+
+// EditMessage replaces what the chain learned from message messageID in
+// chatID with in. Messages that are not in the corpus were never learned,
+// or were forgotten, and are left alone. An empty in only unlearns the
+// message.
+func (c *Chain) EditMessage(chatID int64, messageID int, in string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		corpus := tx.Bucket([]byte("Corpus"))
+		key := corpusKey(chatID, messageID)
+		prev, err := getCorpusEntry(corpus, key)
+		if err != nil || prev == nil {
+			return err
+		}
+
+		delta := newStatsDelta()
+		c.log.Debugf("unlearning previous version of message %s: '%s'", key, prev.Learned)
+		if err := c.unlearn(tx, delta, prev.Learned); err != nil {
+			return err
+		}
+		if in == "" {
+			if err := corpus.Delete(key); err != nil {
+				return err
+			}
+			return delta.write(tx, chatID)
+		}
+		if prev.Learned, err = c.learn(tx, delta, chatID, in); err != nil {
+			return err
+		}
+		if err := putCorpusEntry(corpus, key, *prev); err != nil {
+			return err
+		}
+		return delta.write(tx, chatID)
+	})
+	if err != nil {
+		c.log.Errorf("error when writing to DB: '%s'", err)
+	}
+	return err
+}
+
+// ForgetUser drops the messages of userID from the corpus, in chatID or in
+// every chat if global, and returns how many were dropped. What the chain
+// learned from them stays, but they cannot be edited anymore.
+func (c *Chain) ForgetUser(userID int, chatID int64, global bool) (int, error) {
+	prefix := strconv.FormatInt(chatID, 10) + ":"
+	return c.dropCorpus(func(k []byte, e corpusEntry) bool {
+		return e.UserID == userID && (global || strings.HasPrefix(string(k), prefix))
+	})
+}
+
+// PruneCorpus drops the messages learned more than maxAge ago from the
+// corpus, and returns how many were dropped.
+func (c *Chain) PruneCorpus(maxAge time.Duration) (int, error) {
+	before := time.Now().Add(-maxAge).Unix()
+	return c.dropCorpus(func(k []byte, e corpusEntry) bool {
+		return e.Time < before
+	})
+}
+
+// RunCorpusPruner drops the messages older than maxAge from the corpus every
+// hour. A maxAge of 0 or less keeps them forever.
+func (c *Chain) RunCorpusPruner(maxAge time.Duration) {
+	if maxAge <= 0 {
+		c.log.Warnf("Corpus age is %s, learned messages are kept forever", maxAge)
+		return
+	}
+	ticker := time.NewTicker(time.Hour)
+	go func() {
+		for range ticker.C {
+			n, err := c.PruneCorpus(maxAge)
+			if err != nil {
+				continue
+			}
+			if n > 0 {
+				c.log.Infof("Pruned %d messages older than %s from the corpus", n, maxAge)
+			}
+		}
+	}()
+}
+
+// dropCorpus deletes the corpus entries matched by drop.
+func (c *Chain) dropCorpus(drop func(k []byte, e corpusEntry) bool) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var dropped int
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("Corpus"))
+		var keys [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			var e corpusEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				// left for Check
+				return nil
+			}
+			if drop(k, e) {
+				keys = append(keys, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		dropped = len(keys)
+		return nil
+	})
+	if err != nil {
+		c.log.Errorf("error when pruning the corpus: '%s'", err)
+		return 0, err
+	}
+	return dropped, nil
+}
@@ -0,0 +1,163 @@
+package markov
+
+import (
+	"reflect"
+	"testing"
+)
+
+// edit is a message to learn, or an edit of one when edit is set.
+type edit struct {
+	messageID int
+	text      string
+	edit      bool
+}
+
+func TestEditMessage(t *testing.T) {
+	tests := []struct {
+		name  string
+		edits []edit
+		// want are the messages learning from scratch should give the same
+		// chain and stats as edits.
+		want []string
+	}{
+		{
+			name:  "typo",
+			edits: []edit{{1, "typo wrod here", false}, {1, "typo word here", true}},
+			want:  []string{"typo word here"},
+		},
+		{
+			name:  "emptied",
+			edits: []edit{{1, "a b c", false}, {1, "", true}},
+		},
+		{
+			name:  "never learned",
+			edits: []edit{{1, "a b c", false}, {2, "x y z", true}},
+			want:  []string{"a b c"},
+		},
+		{
+			name:  "shared transitions",
+			edits: []edit{{1, "a b c", false}, {2, "a b d", false}, {1, "x y", true}},
+			want:  []string{"a b d", "x y"},
+		},
+		{
+			name:  "edited twice",
+			edits: []edit{{1, "a b c", false}, {1, "a b", true}, {1, "c b a", true}},
+			want:  []string{"c b a"},
+		},
+		{
+			name:  "repeated words",
+			edits: []edit{{1, "la la la la", false}, {2, "la la land", false}, {1, "la", true}},
+			want:  []string{"la la land", "la"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, done := newTestChain(t)
+			defer done()
+			for _, e := range tt.edits {
+				var err error
+				if e.edit {
+					err = c.EditMessage(1, e.messageID, e.text)
+				} else {
+					_, err = c.AddMessage(1, 1, e.messageID, e.text)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			want, wantDone := newTestChain(t)
+			defer wantDone()
+			for i, m := range tt.want {
+				if _, err := want.AddMessage(1, 1, i, m); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if got, w := dump(t, c), dump(t, want); !reflect.DeepEqual(got, w) {
+				t.Errorf("chain is %v, want %v", got, w)
+			}
+			got, err := c.Stats()
+			if err != nil {
+				t.Fatal(err)
+			}
+			w, err := want.Stats()
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the maximum branching is only recomputed by Check
+			got.MaxBranching, w.MaxBranching = 0, 0
+			if len(got.TopWords)+len(w.TopWords) == 0 {
+				got.TopWords, w.TopWords = nil, nil
+			}
+			if !reflect.DeepEqual(got, w) {
+				t.Errorf("stats are %+v, want %+v", got, w)
+			}
+		})
+	}
+}
+
+func TestEditMessageAfterPurge(t *testing.T) {
+	c, done := newTestChain(t)
+	defer done()
+
+	for i, m := range []string{"a b X c d", "c d e"} {
+		if _, err := c.AddMessage(1, 1, i+1, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.Purge(func(w string) bool { return w == "X" }); err != nil {
+		t.Fatal(err)
+	}
+	// the purge changed what message 1 taught, it cannot be unlearned
+	if err := c.EditMessage(1, 1, "a b"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]suffixes{
+		" ":   {"a": 1, "c": 1},
+		" a":  {"b": 1},
+		" c":  {"d": 1},
+		"c d": {"e": 1},
+	}
+	if got := dump(t, c); !reflect.DeepEqual(got, want) {
+		t.Errorf("chain is %v, want %v", got, want)
+	}
+}
+
+func TestEditMessageAfterReinforce(t *testing.T) {
+	c, done := newTestChain(t)
+	defer done()
+
+	if _, err := c.AddMessage(1, 1, 1, "typo wrod here"); err != nil {
+		t.Fatal(err)
+	}
+	_, trace, _ := c.GenerateChainTrace(1, 5, "typo")
+	applied, err := c.Reinforce(trace, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) == 0 {
+		t.Fatal("reinforced nothing")
+	}
+	if err := c.EditMessage(1, 1, "typo word here"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]suffixes{
+		" ":         {"typo": 1},
+		" typo":     {"word": 1},
+		"typo word": {"here": 1},
+	}
+	if got := dump(t, c); !reflect.DeepEqual(got, want) {
+		t.Errorf("chain is %v, want %v", got, want)
+	}
+	// the feedback on the unlearned transition must be gone too
+	problems, err := c.Check(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range problems {
+		t.Errorf("unexpected problem: %s", p)
+	}
+}
@@ -0,0 +1,127 @@
+package markov
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// minWeight is the lowest weight feedback can bring a transition down to, so
+// a disliked transition becomes unlikely but not impossible.
+const minWeight = 0.1
+
+// ErrForgotten is returned by Reinforce when none of the transitions of the
+// trace are in the chain anymore.
+var ErrForgotten = errors.New("transitions are not in the chain anymore")
+
+// Reinforce adds delta to the feedback of the transitions picked in trace,
+// making them more or less likely to be picked by weighted generation, after
+// reverting prev, what an earlier call for the same trace applied. Feedback
+// is kept in its own bucket, apart from the learned weights, so unlearning
+// is not affected by it. It returns what was added to each transition, for a
+// later call to revert.
+func (c *Chain) Reinforce(trace *Trace, delta int, prev map[Step]int) (map[Step]int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	applied := make(map[Step]int)
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		chain := tx.Bucket([]byte("Chain"))
+		b := tx.Bucket([]byte("Feedback"))
+		for step, n := range prev {
+			if err := addFeedback(b, step.Word, step.Prefix, -n); err != nil {
+				return err
+			}
+		}
+		for _, s := range trace.Steps {
+			step := Step{Prefix: s.Prefix, Word: s.Word}
+			if _, ok := applied[step]; ok {
+				continue
+			}
+			choices, err := decodeSuffixes(chain.Get([]byte(s.Prefix)))
+			if err != nil || choices[s.Word] == 0 {
+				// unlearned since
+				continue
+			}
+			if err := addFeedback(b, s.Word, s.Prefix, delta); err != nil {
+				return err
+			}
+			applied[step] = delta
+		}
+		if len(applied) == 0 {
+			return ErrForgotten
+		}
+		return nil
+	})
+	if err != nil {
+		if err != ErrForgotten {
+			c.log.Errorf("error when reinforcing transitions: '%s'", err)
+		}
+		return nil, err
+	}
+	return applied, nil
+}
+
+// addFeedback adds n to the feedback of the transition from prefix to word,
+// dropping it when it falls back to 0.
+func addFeedback(b *bolt.Bucket, word, prefix string, n int) error {
+	k := predsKey(word, prefix)
+	f, _ := strconv.Atoi(string(b.Get(k)))
+	if f+n == 0 {
+		return b.Delete(k)
+	}
+	return b.Put(k, []byte(strconv.Itoa(f+n)))
+}
+
+// pruneFeedback drops the feedback of the transitions that are not in the
+// chain anymore.
+func pruneFeedback(tx *bolt.Tx) error {
+	b := tx.Bucket([]byte("Feedback"))
+	chain := tx.Bucket([]byte("Chain"))
+	var keys [][]byte
+	err := b.ForEach(func(k, v []byte) error {
+		parts := strings.SplitN(string(k), predsSep, 2)
+		if len(parts) != 2 {
+			// left for Check
+			return nil
+		}
+		v = chain.Get([]byte(parts[1]))
+		if choices, err := decodeSuffixes(v); v == nil || err == nil && choices[parts[0]] == 0 {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// weights returns the weights of the suffixes of prefix for weighted
+// generation, their learned weights adjusted by feedback.
+func weights(b *bolt.Bucket, prefix string, s suffixes) map[string]float64 {
+	w := make(map[string]float64, len(s))
+	for word, n := range s {
+		f, _ := strconv.Atoi(string(b.Get(predsKey(word, prefix))))
+		w[word] = float64(n + f)
+		if w[word] < minWeight {
+			w[word] = minWeight
+		}
+	}
+	return w
+}
+
+// Weighted returns true if generation is weighted, and so feedback has an
+// effect.
+func (c *Chain) Weighted() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.weighted
+}
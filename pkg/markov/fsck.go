@@ -0,0 +1,397 @@
+package markov
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Problem is an inconsistency found in the state DB by Check.
+type Problem struct {
+	Bucket   string
+	Key      string
+	Issue    string
+	Repaired bool
+}
+
+func (p Problem) String() string {
+	s := fmt.Sprintf("%s[%q]: %s", p.Bucket, p.Key, p.Issue)
+	if p.Repaired {
+		s = fmt.Sprintf("%s (repaired)", s)
+	}
+	return s
+}
+
+// fix is a change to a single key, applied once the bucket walk is done.
+// A nil value deletes the key.
+type fix struct {
+	key   []byte
+	value []byte
+}
+
+// Check walks every bucket in the state DB and validates keys and values
+// against the current schema. If repair is true, bad values are rewritten
+// or dropped.
+func (c *Chain) Check(repair bool) ([]Problem, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.dbMutex.RLock()
+	defer c.dbMutex.RUnlock()
+
+	var problems []Problem
+	check := func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			problems = append(problems, Problem{Issue: err.Error()})
+		}
+
+		plen, metaProblems, metaFixes := c.checkMeta(tx.Bucket([]byte("Meta")))
+		chainProblems, chainFixes := checkChain(tx.Bucket([]byte("Chain")), plen)
+
+		err := tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			switch string(name) {
+			case "Chain", "Meta", "Stats", "Words", "Chats", "Preds", "Corpus", "Feedback":
+			default:
+				problems = append(problems, Problem{Bucket: string(name), Issue: "unknown bucket"})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if repair {
+			if err := applyFixes(tx, "Meta", metaFixes, metaProblems); err != nil {
+				return err
+			}
+			if err := applyFixes(tx, "Chain", chainFixes, chainProblems); err != nil {
+				return err
+			}
+		}
+		problems = append(problems, metaProblems...)
+		problems = append(problems, chainProblems...)
+
+		// the index and counters are checked against the chain once it has
+		// been repaired
+		predsProblems, predsFixes := checkPreds(tx)
+		if repair {
+			if err := applyFixes(tx, "Preds", predsFixes, predsProblems); err != nil {
+				return err
+			}
+		}
+		problems = append(problems, predsProblems...)
+
+		for _, name := range []string{"Words", "Chats"} {
+			countProblems, countFixes := checkCounts(tx.Bucket([]byte(name)), name)
+			if repair {
+				if err := applyFixes(tx, name, countFixes, countProblems); err != nil {
+					return err
+				}
+			}
+			problems = append(problems, countProblems...)
+		}
+		feedbackProblems, feedbackFixes := checkFeedback(tx)
+		if repair {
+			if err := applyFixes(tx, "Feedback", feedbackFixes, feedbackProblems); err != nil {
+				return err
+			}
+		}
+		problems = append(problems, feedbackProblems...)
+
+		corpusProblems, corpusFixes := checkCorpus(tx.Bucket([]byte("Corpus")))
+		if repair {
+			if err := applyFixes(tx, "Corpus", corpusFixes, corpusProblems); err != nil {
+				return err
+			}
+		}
+		problems = append(problems, corpusProblems...)
+		statsProblems, statsFixes := checkStats(tx)
+		if repair {
+			if err := applyFixes(tx, "Stats", statsFixes, statsProblems); err != nil {
+				return err
+			}
+		}
+		problems = append(problems, statsProblems...)
+		return nil
+	}
+
+	var err error
+	if repair {
+		err = c.db.Update(check)
+	} else {
+		err = c.db.View(check)
+	}
+	return problems, err
+}
+
+// checkMeta validates the metadata bucket and returns the prefix length the
+// chain keys are expected to have.
+func (c *Chain) checkMeta(b *bolt.Bucket) (int, []Problem, []fix) {
+	if b == nil {
+		return c.prefixLen, []Problem{{Bucket: "Meta", Key: "prefixlen", Issue: "bucket not found"}},
+			[]fix{{key: []byte("prefixlen"), value: []byte(strconv.Itoa(c.prefixLen))}}
+	}
+
+	v := b.Get([]byte("prefixlen"))
+	plen, err := strconv.Atoi(string(v))
+	switch {
+	case v == nil:
+		return c.prefixLen, []Problem{{Bucket: "Meta", Key: "prefixlen", Issue: "prefix length not recorded"}},
+			[]fix{{key: []byte("prefixlen"), value: []byte(strconv.Itoa(c.prefixLen))}}
+	case err != nil || plen < 1:
+		return c.prefixLen, []Problem{{Bucket: "Meta", Key: "prefixlen", Issue: fmt.Sprintf("invalid prefix length '%s'", v)}},
+			[]fix{{key: []byte("prefixlen"), value: []byte(strconv.Itoa(c.prefixLen))}}
+	case plen != c.prefixLen:
+		// not something we can repair, the chain would have to be rebuilt
+		return plen, []Problem{{Bucket: "Meta", Key: "prefixlen", Issue: fmt.Sprintf("prefix length %d differs from configured %d", plen, c.prefixLen)}}, nil
+	}
+	return plen, nil, nil
+}
+
+// checkChain validates every prefix and suffix list in the chain bucket.
+func checkChain(b *bolt.Bucket, plen int) ([]Problem, []fix) {
+	if b == nil {
+		return []Problem{{Bucket: "Chain", Issue: "bucket not found"}}, nil
+	}
+
+	var problems []Problem
+	var fixes []fix
+	b.ForEach(func(k, v []byte) error {
+		key := string(k)
+		if n := len(strings.Split(key, " ")); n != plen {
+			problems = append(problems, Problem{Bucket: "Chain", Key: key, Issue: fmt.Sprintf("prefix has %d words, expected %d", n, plen)})
+			fixes = append(fixes, fix{key: k})
+			return nil
+		}
+
+		choices, err := decodeSuffixes(v)
+		if err != nil {
+			problems = append(problems, Problem{Bucket: "Chain", Key: key, Issue: fmt.Sprintf("cannot unmarshal suffixes: %s", err)})
+			fixes = append(fixes, fix{key: k})
+			return nil
+		}
+
+		clean := make(suffixes)
+		for w, n := range choices {
+			if w != "" && !strings.ContainsAny(w, " \t\n"+predsSep) && n > 0 {
+				clean[w] = n
+			}
+		}
+		switch {
+		case len(clean) == 0:
+			problems = append(problems, Problem{Bucket: "Chain", Key: key, Issue: "no valid suffixes"})
+			fixes = append(fixes, fix{key: k})
+		case len(clean) != len(choices):
+			problems = append(problems, Problem{Bucket: "Chain", Key: key, Issue: fmt.Sprintf("%d invalid suffixes", len(choices)-len(clean))})
+			buf, _ := json.Marshal(clean)
+			fixes = append(fixes, fix{key: k, value: buf})
+		case bytes.HasPrefix(v, []byte("[")):
+			problems = append(problems, Problem{Bucket: "Chain", Key: key, Issue: "suffixes in legacy list format"})
+			buf, _ := json.Marshal(clean)
+			fixes = append(fixes, fix{key: k, value: buf})
+		}
+		return nil
+	})
+	return problems, fixes
+}
+
+// checkPreds checks that the Preds index holds exactly the transitions in the
+// chain, with the same weights.
+func checkPreds(tx *bolt.Tx) ([]Problem, []fix) {
+	b := tx.Bucket([]byte("Preds"))
+	if b == nil {
+		return []Problem{{Bucket: "Preds", Issue: "bucket not found"}}, nil
+	}
+	chain := tx.Bucket([]byte("Chain"))
+
+	var problems []Problem
+	var fixes []fix
+	b.ForEach(func(k, v []byte) error {
+		parts := strings.SplitN(string(k), predsSep, 2)
+		if len(parts) != 2 {
+			problems = append(problems, Problem{Bucket: "Preds", Key: string(k), Issue: "malformed index key"})
+			fixes = append(fixes, fix{key: k})
+			return nil
+		}
+		choices, _ := decodeSuffixes(chain.Get([]byte(parts[1])))
+		if n, _ := strconv.Atoi(string(v)); choices[parts[0]] == 0 || choices[parts[0]] != n {
+			problems = append(problems, Problem{Bucket: "Preds", Key: string(k), Issue: fmt.Sprintf("index weight '%s' does not match chain weight %d", v, choices[parts[0]])})
+			if choices[parts[0]] == 0 {
+				fixes = append(fixes, fix{key: k})
+			} else {
+				fixes = append(fixes, fix{key: k, value: []byte(strconv.Itoa(choices[parts[0]]))})
+			}
+		}
+		return nil
+	})
+	chain.ForEach(func(k, v []byte) error {
+		choices, err := decodeSuffixes(v)
+		if err != nil {
+			return nil
+		}
+		for w, n := range choices {
+			if b.Get(predsKey(w, string(k))) == nil {
+				problems = append(problems, Problem{Bucket: "Preds", Key: string(predsKey(w, string(k))), Issue: "transition missing from index"})
+				fixes = append(fixes, fix{key: predsKey(w, string(k)), value: []byte(strconv.Itoa(n))})
+			}
+		}
+		return nil
+	})
+	return problems, fixes
+}
+
+// checkCounts validates a bucket of per-key counters.
+func checkCounts(b *bolt.Bucket, name string) ([]Problem, []fix) {
+	if b == nil {
+		return []Problem{{Bucket: name, Issue: "bucket not found"}}, nil
+	}
+
+	var problems []Problem
+	var fixes []fix
+	b.ForEach(func(k, v []byte) error {
+		if n, err := strconv.Atoi(string(v)); err != nil || n < 1 {
+			problems = append(problems, Problem{Bucket: name, Key: string(k), Issue: fmt.Sprintf("invalid count '%s'", v)})
+			fixes = append(fixes, fix{key: k})
+		}
+		return nil
+	})
+	return problems, fixes
+}
+
+// checkFeedback checks that feedback is only kept for transitions in the
+// chain.
+func checkFeedback(tx *bolt.Tx) ([]Problem, []fix) {
+	b := tx.Bucket([]byte("Feedback"))
+	if b == nil {
+		return []Problem{{Bucket: "Feedback", Issue: "bucket not found"}}, nil
+	}
+	chain := tx.Bucket([]byte("Chain"))
+
+	var problems []Problem
+	var fixes []fix
+	b.ForEach(func(k, v []byte) error {
+		parts := strings.SplitN(string(k), predsSep, 2)
+		if len(parts) != 2 {
+			problems = append(problems, Problem{Bucket: "Feedback", Key: string(k), Issue: "malformed transition key"})
+			fixes = append(fixes, fix{key: k})
+			return nil
+		}
+		if n, err := strconv.Atoi(string(v)); err != nil || n == 0 {
+			problems = append(problems, Problem{Bucket: "Feedback", Key: string(k), Issue: fmt.Sprintf("invalid feedback '%s'", v)})
+			fixes = append(fixes, fix{key: k})
+			return nil
+		}
+		if choices, _ := decodeSuffixes(chain.Get([]byte(parts[1]))); choices[parts[0]] == 0 {
+			problems = append(problems, Problem{Bucket: "Feedback", Key: string(k), Issue: "feedback on a transition not in the chain"})
+			fixes = append(fixes, fix{key: k})
+		}
+		return nil
+	})
+	return problems, fixes
+}
+
+// checkCorpus validates the keys and entries of the corpus bucket.
+func checkCorpus(b *bolt.Bucket) ([]Problem, []fix) {
+	if b == nil {
+		return []Problem{{Bucket: "Corpus", Issue: "bucket not found"}}, nil
+	}
+
+	var problems []Problem
+	var fixes []fix
+	b.ForEach(func(k, v []byte) error {
+		parts := strings.SplitN(string(k), ":", 2)
+		if len(parts) != 2 {
+			problems = append(problems, Problem{Bucket: "Corpus", Key: string(k), Issue: "malformed message key"})
+			fixes = append(fixes, fix{key: k})
+			return nil
+		}
+		_, cerr := strconv.ParseInt(parts[0], 10, 64)
+		_, merr := strconv.Atoi(parts[1])
+		if cerr != nil || merr != nil {
+			problems = append(problems, Problem{Bucket: "Corpus", Key: string(k), Issue: "malformed message key"})
+			fixes = append(fixes, fix{key: k})
+			return nil
+		}
+		var e corpusEntry
+		if err := json.Unmarshal(v, &e); err != nil {
+			problems = append(problems, Problem{Bucket: "Corpus", Key: string(k), Issue: fmt.Sprintf("cannot unmarshal entry: %s", err)})
+			fixes = append(fixes, fix{key: k})
+			return nil
+		}
+		if e.Time <= 0 {
+			problems = append(problems, Problem{Bucket: "Corpus", Key: string(k), Issue: "entry has no learning time, it would never be pruned"})
+			fixes = append(fixes, fix{key: k})
+		}
+		return nil
+	})
+	return problems, fixes
+}
+
+// checkStats compares the statistics counters with a full count of the chain.
+func checkStats(tx *bolt.Tx) ([]Problem, []fix) {
+	var problems []Problem
+	var fixes []fix
+
+	b := tx.Bucket([]byte("Stats"))
+	if b == nil {
+		problems = append(problems, Problem{Bucket: "Stats", Issue: "bucket not found"})
+	}
+	cc := countChain(tx.Bucket([]byte("Chain")))
+	var vocabulary int
+	if words := tx.Bucket([]byte("Words")); words != nil {
+		vocabulary = words.Stats().KeyN
+	}
+
+	counted := map[string]int{
+		"prefixes":    cc.prefixes,
+		"transitions": cc.transitions,
+		"maxbranch":   cc.maxBranching,
+		"vocabulary":  vocabulary,
+	}
+	for _, k := range []string{"prefixes", "transitions", "maxbranch", "vocabulary"} {
+		want := counted[k]
+		var got int
+		if b != nil {
+			got = getCount(b, k)
+		}
+		if got != want {
+			problems = append(problems, Problem{Bucket: "Stats", Key: k, Issue: fmt.Sprintf("counter is %d, counted %d", got, want)})
+			fixes = append(fixes, fix{key: []byte(k), value: []byte(strconv.Itoa(want))})
+		}
+	}
+	return problems, fixes
+}
+
+// applyFixes writes fixes to bucket, marking the problems they solve as
+// repaired. The problems reported for a bucket pair up with its fixes by key.
+func applyFixes(tx *bolt.Tx, bucket string, fixes []fix, problems []Problem) error {
+	if len(fixes) == 0 {
+		return nil
+	}
+	b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+	if err != nil {
+		return err
+	}
+
+	fixed := make(map[string]bool)
+	for _, f := range fixes {
+		if f.value == nil {
+			err = b.Delete(f.key)
+		} else {
+			err = b.Put(f.key, f.value)
+		}
+		if err != nil {
+			return err
+		}
+		fixed[string(f.key)] = true
+	}
+	for i := range problems {
+		if fixed[problems[i].Key] {
+			problems[i].Repaired = true
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package markov
+
+import (
+	"reflect"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestCheckRepairsChainAndPreds(t *testing.T) {
+	c, done := newTestChain(t)
+	defer done()
+
+	for i, m := range []string{"a b c", "a b d"} {
+		if _, err := c.AddMessage(1, 1, i, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	badPred := string(predsKey("b", " a"))
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket([]byte("Chain")).Put([]byte("a b"), []byte(`{"c":1,"d":0}`)); err != nil {
+			return err
+		}
+		return tx.Bucket([]byte("Preds")).Put([]byte(badPred), []byte("7"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, repair := range []bool{false, true} {
+		problems, err := c.Check(repair)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := make(map[string]bool)
+		for _, p := range problems {
+			if p.Repaired != repair {
+				t.Errorf("repair %t: problem %s", repair, p)
+			}
+			found[p.Bucket+"/"+p.Key] = true
+		}
+		for _, k := range []string{"Chain/a b", "Preds/" + badPred} {
+			if !found[k] {
+				t.Errorf("repair %t: %s not reported, got %v", repair, k, problems)
+			}
+		}
+	}
+
+	problems, err := c.Check(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range problems {
+		t.Errorf("problem left after repair: %s", p)
+	}
+	want := map[string]suffixes{
+		" ":   {"a": 2},
+		" a":  {"b": 2},
+		"a b": {"c": 1},
+	}
+	if got := dump(t, c); !reflect.DeepEqual(got, want) {
+		t.Errorf("chain is %v, want %v", got, want)
+	}
+}
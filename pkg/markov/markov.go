@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"math/rand"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -35,91 +36,198 @@ func (p Prefix) Shift(word string) {
 type Chain struct {
 	prefixLen int
 	mutex     sync.Mutex
+	rand      *rand.Rand
 	log       *logrus.Entry
-	DB        *bolt.DB
+	// dbMutex guards db against being swapped while in use outside of mutex.
+	dbMutex sync.RWMutex
+	db      *bolt.DB
+	path    string
+	// blocklist holds the words never to learn nor say, if set.
+	blocklist Blocklist
+	// weighted picks continuations proportionally to their weight instead
+	// of uniformly.
+	weighted bool
 }
 
 type oldChain struct {
 	Chain map[string][]string
 }
 
-// NewChain initializes a new Chain struct.
-func NewChain(prefixLen int, logger *logrus.Logger) *Chain {
+// NewChain initializes a new Chain struct, drawing random numbers from src.
+// If src is nil, a source seeded with the current time is used.
+func NewChain(prefixLen int, src rand.Source, logger *logrus.Logger) *Chain {
 	logfield := logger.WithField("component", "markov")
 	return &Chain{
 		prefixLen: prefixLen,
+		rand:      rand.New(LockSource(src)),
 		log:       logfield,
 	}
 }
 
-// AddChain adds a new message to the chain
-func (c *Chain) AddChain(in string) (int, error) {
-	sr := strings.NewReader(in)
-	p := make(Prefix, c.prefixLen)
-	for {
-		var s string
-		if _, err := fmt.Fscan(sr, &s); err != nil {
-			break
+// learn adds the transitions of in, a message from chatID, to the chain,
+// recording the changes to the statistics in delta. Blocked words are left
+// out, and the words following them are learned as the start of a new
+// message. It returns what was learned, with the fragments of in separated
+// by newlines, for unlearn.
+func (c *Chain) learn(tx *bolt.Tx, delta *statsDelta, chatID int64, in string) (string, error) {
+	fragments := c.fragments(chatID, in)
+	for _, fragment := range fragments {
+		if err := c.learnFragment(tx, delta, fragment); err != nil {
+			return "", err
 		}
+	}
+	learned := make([]string, len(fragments))
+	for i, fragment := range fragments {
+		learned[i] = strings.Join(fragment, " ")
+	}
+	return strings.Join(learned, "\n"), nil
+}
+
+// learnFragment adds the transitions of words to the chain, as a message of
+// its own.
+func (c *Chain) learnFragment(tx *bolt.Tx, delta *statsDelta, words []string) error {
+	b := tx.Bucket([]byte("Chain"))
+	preds := tx.Bucket([]byte("Preds"))
+	p := make(Prefix, c.prefixLen)
+	for _, s := range words {
 		key := p.String()
-		c.mutex.Lock()
+		p.Shift(s)
 
 		c.log.Debugf("reading key '%s' from database", key)
-		v, err := c.readDB([]byte(key))
-		if err != nil {
-			c.log.Errorf("error when reading from DB: '%s'", err)
-		}
+		v := b.Get([]byte(key))
 
-		// tossSalad takes the data, dedupes and add the new word to it
+		// tossSalad takes the data and adds the new word to it
 		c.log.Debugf("tossing salad with salad length %d and ingredient '%s'", len(v), s)
-		buf, err := c.tossSalad(v, s)
+		salad, added, err := c.tossSalad(v, s)
 		if err != nil {
-			c.log.Errorf("error when tossing salad: '%s'", err)
+			// do not overwrite what we cannot read, fsck can deal with it
+			c.log.Errorf("error when tossing salad for key '%s', run fsck: '%s'", key, err)
+			continue
 		}
+		delta.learn(s, v == nil, added, len(salad))
 
-		c.log.Debugf("writing key '%s' to database with payload length: %d", key, len(buf))
-		err = c.writeDB([]byte(key), buf)
+		buf, err := json.Marshal(salad)
 		if err != nil {
-			c.log.Errorf("error when writing to DB: '%s'", err)
+			return err
+		}
+		c.log.Debugf("writing key '%s' to database with payload length: %d", key, len(buf))
+		if err := b.Put([]byte(key), buf); err != nil {
+			return err
+		}
+		if err := addPred(preds, s, key, 1); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		c.mutex.Unlock()
+// unlearn removes the transitions learned by learn from the chain, given
+// what it returned, recording the changes to the statistics in delta.
+// Transitions that are not in the chain are skipped.
+func (c *Chain) unlearn(tx *bolt.Tx, delta *statsDelta, learned string) error {
+	for _, fragment := range strings.Split(learned, "\n") {
+		if err := c.unlearnFragment(tx, delta, strings.Fields(fragment)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Chain) unlearnFragment(tx *bolt.Tx, delta *statsDelta, words []string) error {
+	b := tx.Bucket([]byte("Chain"))
+	preds := tx.Bucket([]byte("Preds"))
+	p := make(Prefix, c.prefixLen)
+	for _, s := range words {
+		key := p.String()
 		p.Shift(s)
+
+		v := b.Get([]byte(key))
+		if v == nil {
+			continue
+		}
+		salad, err := decodeSuffixes(v)
+		if err != nil {
+			c.log.Errorf("error when decoding suffixes for key '%s', run fsck: '%s'", key, err)
+			continue
+		}
+		if salad[s] == 0 {
+			continue
+		}
+
+		salad[s]--
+		removed := salad[s] == 0
+		if removed {
+			delete(salad, s)
+		}
+		delta.unlearn(s, len(salad) == 0, removed)
+
+		if len(salad) == 0 {
+			err = b.Delete([]byte(key))
+		} else {
+			var buf []byte
+			if buf, err = json.Marshal(salad); err == nil {
+				err = b.Put([]byte(key), buf)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if err := addPred(preds, s, key, -1); err != nil {
+			return err
+		}
+		if removed {
+			// feedback goes with the transition
+			if err := tx.Bucket([]byte("Feedback")).Delete(predsKey(s, key)); err != nil {
+				return err
+			}
+		}
 	}
-	return len(in), nil
+	return nil
 }
 
-// GenerateChain generates a markov chain.
+// GenerateChain generates a markov chain, leaving out the words blocked
+// everywhere.
 func (c *Chain) GenerateChain(n int, seed string) (string, time.Duration) {
+	out, _, elapsed := c.GenerateChainTrace(0, n, seed)
+	return out, elapsed
+}
+
+// GenerateChainTrace generates a markov chain for chatID like GenerateChain,
+// also leaving out the words blocked in chatID, and returns a trace of how it
+// was built.
+func (c *Chain) GenerateChainTrace(chatID int64, n int, seed string) (string, *Trace, time.Duration) {
 	t := time.Now().UTC()
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
+	trace := &Trace{Seed: seed}
 	p := make(Prefix, c.prefixLen)
 	c.log.Debugf("Stemming and evaluating seed string %q", seed)
-	// TODO(frapposelli): remove hardcoded bot name
-	seed = strings.TrimPrefix(seed, "@nocino_bot")
 	seedSplit := strings.Split(seed, " ")
 	var candidates []string
 	c.log.Debugf("Evaluating candidates %+v", seedSplit)
 	for _, v := range seedSplit {
-		if len(v) > 3 {
+		if len(v) > 3 && !c.blocked(chatID, v) {
 			candidates = append(candidates, v)
 		}
 	}
 	var words []string
 	c.log.Debugf("Candidates found: %d", len(candidates))
+	trace.Candidates = candidates
 	if len(candidates) > 0 {
-		for _, i := range rand.Perm(len(candidates)) {
+		for _, i := range c.rand.Perm(len(candidates)) {
 			var found []byte
 			v := candidates[i]
 			c.log.Debugf("Evaluating word: %q", v)
-			evalW := fmt.Sprintf(" %s", v)
-			found, err := c.readDB([]byte(evalW))
+			// a seed must have started a message
+			evalP := make(Prefix, c.prefixLen)
+			evalP.Shift(v)
+			found, err := c.readDB([]byte(evalP.String()))
 			if err != nil {
 				c.log.Errorf("error when reading from DB: '%s'", err)
 			}
 			if found != nil {
 				c.log.Debugf("Found starting word to use for chain: %q", v)
+				trace.Chosen = v
 				words = append(words, v)
 				p.Shift(v)
 				break
@@ -127,26 +235,40 @@ func (c *Chain) GenerateChain(n int, seed string) (string, time.Duration) {
 		}
 	}
 	for i := 0; i < n; i++ {
-		var choices []string
 		c.log.Debugf("generating markov chain: reading '%s' from DB", p.String())
 		v, err := c.readDB([]byte(p.String()))
 		if err != nil {
 			c.log.Errorf("error when reading from DB: '%s'", err)
 		}
 
-		json.Unmarshal(v, &choices)
+		var choices suffixes
+		if v != nil {
+			if choices, err = decodeSuffixes(v); err != nil {
+				c.log.Errorf("corrupt suffixes for key '%s', run fsck: '%s'", p.String(), err)
+			}
+		}
+		for w := range choices {
+			if c.blocked(chatID, w) {
+				delete(choices, w)
+			}
+		}
 
 		if len(choices) == 0 {
 			c.log.Debugf("we ran out of choices, breaking out of markov chain generation")
 			break
 		}
 
-		next := choices[rand.Intn(len(choices))]
+		var w map[string]float64
+		if c.weighted {
+			w = c.readWeights(p.String(), choices)
+		}
+		next := choices.pick(c.rand, w)
+		trace.Steps = append(trace.Steps, Step{Prefix: p.String(), Choices: len(choices), Word: next})
 		words = append(words, next)
 		c.log.Debugf("generating markov chain: words connected '%v'", words)
 		p.Shift(next)
 	}
-	return strings.Join(words, " "), time.Since(t)
+	return strings.Join(words, " "), trace, time.Since(t)
 }
 
 // ReadState reads from a json-formatted state file.
@@ -161,23 +283,84 @@ func (c *Chain) ReadState(fileName string) {
 			c.ImportOldState(oldStateFile, fileName)
 		}
 	}
-	bdb, err := bolt.Open(fileName, 0600, &bolt.Options{Timeout: 1 * time.Second})
-	c.DB = bdb
+	bdb, err := c.openDB(fileName)
+	if err != nil {
+		c.log.Fatalf("Cannot open state file '%s': '%s'", fileName, err)
+	}
+	c.db = bdb
+	c.path = fileName
+
+	c.log.Infof("Loaded state from '%s' (%d suffixes).", fileName, c.Size())
+	return
+}
+
+// Size returns the number of prefixes stored in the chain.
+func (c *Chain) Size() int {
+	c.dbMutex.RLock()
+	defer c.dbMutex.RUnlock()
+
+	var keys int
+	err := c.db.View(func(tx *bolt.Tx) error {
+		keys = tx.Bucket([]byte("Chain")).Stats().KeyN
+		return nil
+	})
+	if err != nil {
+		c.log.Errorf("boltdb transaction failed with: '%s'", err)
+	}
+	return keys
+}
+
+// SetWeighted makes generation pick continuations proportionally to how many
+// times they were learned, adjusted by the feedback they got, instead of
+// uniformly.
+func (c *Chain) SetWeighted(weighted bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.weighted = weighted
+}
+
+// Close closes the underlying state DB.
+func (c *Chain) Close() error {
+	c.dbMutex.Lock()
+	defer c.dbMutex.Unlock()
+	return c.db.Close()
+}
 
-	var bucketStats int
-	err = c.DB.Update(func(tx *bolt.Tx) error {
-		b, err := tx.CreateBucketIfNotExists([]byte("Chain"))
+// openDB opens the bolt state file at fileName, making sure the chain and
+// statistics buckets exist and recording the prefix length the chain is
+// built with.
+func (c *Chain) openDB(fileName string) (*bolt.DB, error) {
+	bdb, err := bolt.Open(fileName, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = bdb.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{"Chain", "Corpus", "Feedback"} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		meta, err := tx.CreateBucketIfNotExists([]byte("Meta"))
 		if err != nil {
 			return err
 		}
-		bucketStats = b.Stats().KeyN
-		return nil
+		if v := meta.Get([]byte("prefixlen")); v != nil {
+			if plen, err := strconv.Atoi(string(v)); err != nil || plen != c.prefixLen {
+				c.log.Warnf("State file '%s' was built with prefix length '%s', but %d is configured", fileName, v, c.prefixLen)
+			}
+		} else if err := meta.Put([]byte("prefixlen"), []byte(strconv.Itoa(c.prefixLen))); err != nil {
+			return err
+		}
+		if err := c.checkSchema(tx); err != nil {
+			return err
+		}
+		return c.initStats(tx)
 	})
 	if err != nil {
-		c.log.Errorf("boltdb transaction failed with: '%s'", err)
+		bdb.Close()
+		return nil, err
 	}
-	c.log.Infof("Loaded state from '%s' (%d suffixes).", fileName, bucketStats)
-	return
+	return bdb, nil
 }
 
 // ImportOldState imports old state from GZIP'd state file
@@ -230,7 +413,8 @@ func (c *Chain) ImportOldState(oldStateFile string, newFilename string) {
 			}
 			b.Put([]byte(k), buf)
 		}
-		return nil
+		// a new file, nothing to keep readable by older versions
+		return c.migrate(tx)
 	})
 	if err != nil {
 		c.log.Errorf("boltdb transaction failed with: '%s'", err)
@@ -241,7 +425,7 @@ func (c *Chain) ImportOldState(oldStateFile string, newFilename string) {
 
 func (c *Chain) readDB(key []byte) ([]byte, error) {
 	var value []byte
-	err := c.DB.View(func(tx *bolt.Tx) error {
+	err := c.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("Chain"))
 		value = b.Get(key)
 		return nil
@@ -249,46 +433,41 @@ func (c *Chain) readDB(key []byte) ([]byte, error) {
 	return value, err
 }
 
-func (c *Chain) writeDB(key, value []byte) error {
-	return c.DB.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("Chain"))
-		err := b.Put(key, value)
-		return err
+// readWeights returns the weights of the suffixes of prefix for weighted
+// generation.
+func (c *Chain) readWeights(prefix string, s suffixes) map[string]float64 {
+	var w map[string]float64
+	err := c.db.View(func(tx *bolt.Tx) error {
+		w = weights(tx.Bucket([]byte("Feedback")), prefix, s)
+		return nil
 	})
+	if err != nil {
+		c.log.Errorf("error when reading from DB: '%s'", err)
+	}
+	return w
 }
 
-func (c *Chain) tossSalad(salad []byte, ingredient string) ([]byte, error) {
-	var wordSalad []string
-	var found bool
+// tossSalad adds ingredient to the word salad, or bumps its weight if it is
+// already in it, and reports whether it was added.
+func (c *Chain) tossSalad(salad []byte, ingredient string) (suffixes, bool, error) {
+	wordSalad := make(suffixes)
 	if salad != nil {
-		// if salad is not nil, we unmarshal it and look into it to see if we have to write
-		err := json.Unmarshal(salad, &wordSalad)
+		// if salad is not nil, we unmarshal it and look into it to see if it's new
+		var err error
+		wordSalad, err = decodeSuffixes(salad)
 		if err != nil {
 			c.log.Errorf("error when unmarshaling %+v to json, len '%d'", salad, len(salad))
-			return nil, err
+			return nil, false, err
 		}
 		c.log.Debugf("fetched wordSalad with length: %d", len(wordSalad))
-		for _, v := range wordSalad {
-			if ingredient == v {
-				// we set found = true, and let it skip
-				found = true
-				break
-			}
-		}
-	} else {
-		// if salad is nil, we append the first item to it and return
-		wordSalad = append(wordSalad, ingredient)
-		c.log.Debugf("empty wordSalad, appending first item to it")
-		return json.Marshal(wordSalad)
 	}
 
+	_, found := wordSalad[ingredient]
+	wordSalad[ingredient]++
 	if !found {
-		// if it wasn't found in the search, we just append to it
-		wordSalad = append(wordSalad, ingredient)
 		c.log.Debugf("appending this ingredient to wordSalad: '%s'", ingredient)
 	}
-
-	return json.Marshal(wordSalad)
+	return wordSalad, !found, nil
 }
 
 // Deduplicate returns a new slice with duplicates values removed.
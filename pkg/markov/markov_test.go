@@ -0,0 +1,77 @@
+package markov
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// newTestChain returns a chain with prefix length 2 over a temporary state
+// file, drawing random numbers from a source seeded with 42, and a function
+// closing and removing it.
+func newTestChain(t *testing.T) (*Chain, func()) {
+	dir, err := ioutil.TempDir("", "nocino-markov-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	c := NewChain(2, NewSource(42), logger)
+	c.ReadState(filepath.Join(dir, "state.db"))
+	return c, func() {
+		c.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// dump returns the prefixes in the chain with their suffixes.
+func dump(t *testing.T, c *Chain) map[string]suffixes {
+	chain := make(map[string]suffixes)
+	err := c.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("Chain")).ForEach(func(k, v []byte) error {
+			s, err := decodeSuffixes(v)
+			chain[string(k)] = s
+			return err
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chain
+}
+
+// generate learns messages into a new chain and generates a reply to seed.
+func generate(t *testing.T, messages []string, seed string) string {
+	c, done := newTestChain(t)
+	defer done()
+
+	for i, m := range messages {
+		if _, err := c.AddMessage(1, 1, i, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out, _ := c.GenerateChain(20, seed)
+	return out
+}
+
+func TestGenerateChainReproducible(t *testing.T) {
+	messages := []string{
+		"the cat sat on the mat and the dog sat on the cat",
+		"the dog ate the bone and the cat ate the fish",
+		"a cat and a dog walk into a bar",
+	}
+	first := generate(t, messages, "what about the cat")
+	if first == "" {
+		t.Fatal("generated nothing")
+	}
+	for i := 0; i < 5; i++ {
+		if got := generate(t, messages, "what about the cat"); got != first {
+			t.Fatalf("run %d generated '%s', want '%s'", i+2, got, first)
+		}
+	}
+}
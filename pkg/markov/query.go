@@ -0,0 +1,121 @@
+package markov
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Transition is a prefix followed by a word, with the number of times the
+// chain learned it.
+type Transition struct {
+	Prefix string
+	Word   string
+	Weight int
+}
+
+// Suffixes returns the words that followed the given words, heaviest first.
+// With as many words as the prefix length, or more, the transitions of the
+// prefix made of the last words are returned. With fewer words, transitions
+// are gathered from every prefix ending with them.
+func (c *Chain) Suffixes(words ...string) ([]Transition, error) {
+	c.dbMutex.RLock()
+	defer c.dbMutex.RUnlock()
+
+	var transitions []Transition
+	err := c.db.View(func(tx *bolt.Tx) error {
+		chain := tx.Bucket([]byte("Chain"))
+		if len(words) >= c.prefixLen {
+			prefix := strings.Join(words[len(words)-c.prefixLen:], " ")
+			transitions = appendSuffixes(transitions, prefix, chain.Get([]byte(prefix)))
+			return nil
+		}
+		if len(words) == 0 {
+			return nil
+		}
+
+		// the prefixes ending with words are the ones that follow the
+		// predecessors of the last word, shifted by it
+		last := words[len(words)-1]
+		seen := make(map[string]bool)
+		for _, t := range predecessors(tx.Bucket([]byte("Preds")), last) {
+			p := Prefix(strings.Split(t.Prefix, " "))
+			p.Shift(last)
+			if seen[p.String()] || !hasSuffix(p, words) {
+				continue
+			}
+			seen[p.String()] = true
+			transitions = appendSuffixes(transitions, p.String(), chain.Get([]byte(p.String())))
+		}
+		return nil
+	})
+	sortTransitions(transitions)
+	return transitions, err
+}
+
+// Predecessors returns the transitions leading to word, heaviest first.
+func (c *Chain) Predecessors(word string) ([]Transition, error) {
+	c.dbMutex.RLock()
+	defer c.dbMutex.RUnlock()
+
+	var transitions []Transition
+	err := c.db.View(func(tx *bolt.Tx) error {
+		transitions = predecessors(tx.Bucket([]byte("Preds")), word)
+		return nil
+	})
+	sortTransitions(transitions)
+	return transitions, err
+}
+
+// predecessors looks up the transitions to word in the Preds index.
+func predecessors(b *bolt.Bucket, word string) []Transition {
+	var transitions []Transition
+	seek := []byte(word + predsSep)
+	cur := b.Cursor()
+	for k, v := cur.Seek(seek); k != nil && bytes.HasPrefix(k, seek); k, v = cur.Next() {
+		n, _ := strconv.Atoi(string(v))
+		transitions = append(transitions, Transition{
+			Prefix: string(k[len(seek):]),
+			Word:   word,
+			Weight: n,
+		})
+	}
+	return transitions
+}
+
+// appendSuffixes appends the transitions from prefix stored in v to t.
+func appendSuffixes(t []Transition, prefix string, v []byte) []Transition {
+	if v == nil {
+		return t
+	}
+	s, err := decodeSuffixes(v)
+	if err != nil {
+		return t
+	}
+	for _, w := range s.words() {
+		t = append(t, Transition{Prefix: prefix, Word: w, Weight: s[w]})
+	}
+	return t
+}
+
+// hasSuffix returns true if the prefix p ends with words.
+func hasSuffix(p Prefix, words []string) bool {
+	if len(words) > len(p) {
+		return false
+	}
+	for i, w := range words {
+		if p[len(p)-len(words)+i] != w {
+			return false
+		}
+	}
+	return true
+}
+
+func sortTransitions(t []Transition) {
+	sort.SliceStable(t, func(i, j int) bool {
+		return t[i].Weight > t[j].Weight
+	})
+}
@@ -0,0 +1,44 @@
+package markov
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// lockedSource is a rand.Source that is safe for concurrent use, so it can
+// be shared by the chain and the handlers.
+type lockedSource struct {
+	mutex sync.Mutex
+	src   rand.Source
+}
+
+// NewSource returns a rand.Source seeded with seed that is safe for
+// concurrent use. The same seed, state and input make for the same replies.
+func NewSource(seed int64) rand.Source {
+	return &lockedSource{src: rand.NewSource(seed)}
+}
+
+// LockSource makes src safe for concurrent use, unless it already is.
+// A nil src is replaced by one seeded with the current time.
+func LockSource(src rand.Source) rand.Source {
+	switch src.(type) {
+	case nil:
+		return NewSource(time.Now().UnixNano())
+	case *lockedSource:
+		return src
+	}
+	return &lockedSource{src: src}
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.src.Seed(seed)
+}
@@ -0,0 +1,174 @@
+package markov
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Restore validates the backup at path and swaps it in as the live state DB
+// while the chain is in use. The state DB it replaces is kept aside and can
+// be brought back with Rollback.
+func (c *Chain) Restore(path string) error {
+	staged, err := c.stageBackup(path)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(staged)
+
+	if err := ValidateState(staged); err != nil {
+		return fmt.Errorf("backup '%s' is not valid: %s", path, err)
+	}
+
+	c.log.Warnf("Restoring state from backup '%s'", path)
+	return c.swap(staged)
+}
+
+// Rollback swaps the state DB replaced by the last Restore back in. Calling
+// it twice in a row gets back to where it started.
+func (c *Chain) Rollback() error {
+	prev := c.prevPath()
+	if _, err := os.Stat(prev); err != nil {
+		return fmt.Errorf("no previous state to roll back to: %s", err)
+	}
+	if err := ValidateState(prev); err != nil {
+		return fmt.Errorf("previous state '%s' is not valid: %s", prev, err)
+	}
+
+	c.log.Warnf("Rolling back state to '%s'", prev)
+	return c.swap(prev)
+}
+
+// ValidateState checks that the bolt file at path is a consistent state DB
+// that the chain can be served from.
+func ValidateState(path string) error {
+	bdb, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer bdb.Close()
+
+	return bdb.View(func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			return err
+		}
+		b := tx.Bucket([]byte("Chain"))
+		if b == nil {
+			return fmt.Errorf("bucket '%s' not found", "Chain")
+		}
+		var bad int
+		err := b.ForEach(func(k, v []byte) error {
+			if _, err := decodeSuffixes(v); err != nil {
+				bad++
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if bad > 0 {
+			return fmt.Errorf("%d corrupt values in bucket '%s'", bad, "Chain")
+		}
+		return nil
+	})
+}
+
+// stageBackup copies the backup at path next to the state file, so it can be
+// renamed into place, decompressing it if needed.
+func (c *Chain) stageBackup(path string) (string, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	var r io.Reader = in
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(in)
+		if err != nil {
+			return "", err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	out, err := ioutil.TempFile(filepath.Dir(c.path), ".restore-")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(out, r)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return "", err
+	}
+	return out.Name(), nil
+}
+
+// swap closes the live state DB, moves it aside to the previous state path
+// and opens next in its place. Chain operations block until the swap is done.
+func (c *Chain) swap(next string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.swapLocked(next, c.prevPath())
+}
+
+// swapLocked replaces the live state DB with next, moving the current one to
+// prev. The caller must hold mutex.
+func (c *Chain) swapLocked(next string, prev string) error {
+	c.dbMutex.Lock()
+	defer c.dbMutex.Unlock()
+
+	aside := fmt.Sprintf("%s.swap", c.path)
+
+	if err := c.db.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(c.path, aside); err != nil {
+		return c.reopen(err)
+	}
+	if err := os.Rename(next, c.path); err != nil {
+		os.Rename(aside, c.path)
+		return c.reopen(err)
+	}
+	if err := os.Rename(aside, prev); err != nil {
+		c.log.Errorf("cannot keep previous state as '%s': '%s'", prev, err)
+	}
+
+	bdb, err := c.openDB(c.path)
+	if err != nil {
+		// the new state is unusable, put the previous one back
+		os.Rename(prev, c.path)
+		return c.reopen(err)
+	}
+	c.db = bdb
+	c.log.Infof("Swapped in new state at '%s', previous state kept as '%s'", c.path, prev)
+	return nil
+}
+
+// reopen reopens the state file after a failed swap and returns cause.
+func (c *Chain) reopen(cause error) error {
+	bdb, err := c.openDB(c.path)
+	if err != nil {
+		c.log.Fatalf("Cannot reopen state file '%s' after failed swap: '%s'", c.path, err)
+	}
+	c.db = bdb
+	return cause
+}
+
+func (c *Chain) prevPath() string {
+	return fmt.Sprintf("%s.prev", c.path)
+}
@@ -0,0 +1,228 @@
+package markov
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"sort"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// schemaVersion is the version of the state DB layout written by this code.
+//
+//	1: Chain maps a prefix to a JSON list of the words that followed it.
+//	2: Chain maps a prefix to a JSON object of the words that followed it and
+//	   how many times they did, Preds indexes transitions by their word.
+const schemaVersion = 2
+
+// ErrOutdatedSchema is returned when opening a state DB written with an older
+// schema. Upgrading it cannot be undone, so it is left to Migrate.
+var ErrOutdatedSchema = errors.New("state file uses an older schema, run 'nocino migrate' to upgrade it")
+
+// predsSep separates the word from the prefix in the keys of the Preds index.
+const predsSep = "\x00"
+
+// suffixes maps the words that followed a prefix to the number of times
+// they did.
+type suffixes map[string]int
+
+// decodeSuffixes unmarshals a Chain value, accepting the plain word lists of
+// schema version 1 as words with a weight of 1.
+func decodeSuffixes(v []byte) (suffixes, error) {
+	s := make(suffixes)
+	if bytes.HasPrefix(bytes.TrimSpace(v), []byte("[")) {
+		var words []string
+		if err := json.Unmarshal(v, &words); err != nil {
+			return nil, err
+		}
+		for _, w := range words {
+			s[w] = 1
+		}
+		return s, nil
+	}
+	if err := json.Unmarshal(v, &s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// words returns the suffixes sorted by descending weight, ties broken
+// alphabetically so the order does not depend on map iteration.
+func (s suffixes) words() []string {
+	words := make([]string, 0, len(s))
+	for w := range s {
+		words = append(words, w)
+	}
+	sort.Slice(words, func(i, j int) bool {
+		if s[words[i]] != s[words[j]] {
+			return s[words[i]] > s[words[j]]
+		}
+		return words[i] < words[j]
+	})
+	return words
+}
+
+// pick returns a random suffix drawn from r. Every word is as likely as the
+// others unless weights are given, then words are picked proportionally to
+// their weight.
+func (s suffixes) pick(r *rand.Rand, weights map[string]float64) string {
+	if weights == nil {
+		if len(s) == 0 {
+			return ""
+		}
+		return s.words()[r.Intn(len(s))]
+	}
+	var total float64
+	for w := range s {
+		total += weights[w]
+	}
+	if total <= 0 {
+		return ""
+	}
+	n := r.Float64() * total
+	words := s.words()
+	for _, w := range words {
+		if n -= weights[w]; n < 0 {
+			return w
+		}
+	}
+	// rounding left us past the end
+	return words[len(words)-1]
+}
+
+// predsKey returns the key of the transition from prefix to word in the
+// Preds index.
+func predsKey(word, prefix string) []byte {
+	return []byte(word + predsSep + prefix)
+}
+
+// addPred adds n to the weight of the transition from prefix to word in the
+// Preds index, dropping the transition when its weight falls to 0.
+func addPred(b *bolt.Bucket, word, prefix string, n int) error {
+	k := predsKey(word, prefix)
+	w, _ := strconv.Atoi(string(b.Get(k)))
+	if w+n <= 0 {
+		return b.Delete(k)
+	}
+	return b.Put(k, []byte(strconv.Itoa(w+n)))
+}
+
+// checkSchema makes sure the state DB in tx uses schemaVersion. An empty
+// chain is brought up to it, an older one makes it fail with
+// ErrOutdatedSchema.
+func (c *Chain) checkSchema(tx *bolt.Tx) error {
+	if schemaOf(tx) >= schemaVersion {
+		return nil
+	}
+	if k, _ := tx.Bucket([]byte("Chain")).Cursor().First(); k != nil {
+		return ErrOutdatedSchema
+	}
+	return c.migrate(tx)
+}
+
+// Migrate upgrades the state file at fileName to schemaVersion, after backing
+// it up into backupDir. The upgraded file cannot be read by older versions.
+func (c *Chain) Migrate(fileName string, backupDir string) error {
+	bdb, err := bolt.Open(fileName, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return err
+	}
+	defer bdb.Close()
+
+	var version int
+	err = bdb.View(func(tx *bolt.Tx) error {
+		version = schemaOf(tx)
+		return nil
+	})
+	if err != nil || version >= schemaVersion {
+		return err
+	}
+
+	path, _, err := backup(bdb, fileName, backupDir, true)
+	if err != nil {
+		return err
+	}
+	c.log.Infof("Backed up state to '%s' before migrating", path)
+
+	return bdb.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists([]byte("Chain")); err != nil {
+			return err
+		}
+		c.log.Warnf("Migrating state from schema version %d to %d", version, schemaVersion)
+		return c.migrate(tx)
+	})
+}
+
+// schemaOf returns the schema version of the state DB in tx. State DBs from
+// before versions were recorded are version 1.
+func schemaOf(tx *bolt.Tx) int {
+	var version int
+	if meta := tx.Bucket([]byte("Meta")); meta != nil {
+		version, _ = strconv.Atoi(string(meta.Get([]byte("version"))))
+	}
+	if version == 0 {
+		version = 1
+	}
+	return version
+}
+
+// migrate brings the state DB in tx up to schemaVersion: transitions get a
+// weight of 1 and the Preds index is built.
+func (c *Chain) migrate(tx *bolt.Tx) error {
+	meta, err := tx.CreateBucketIfNotExists([]byte("Meta"))
+	if err != nil {
+		return err
+	}
+	if err := rebuildChain(tx); err != nil {
+		return err
+	}
+	return meta.Put([]byte("version"), []byte(strconv.Itoa(schemaVersion)))
+}
+
+// rebuildChain rewrites every Chain value in the current format and rebuilds
+// the Preds index from scratch. Values that cannot be decoded are left for
+// Check to deal with.
+func rebuildChain(tx *bolt.Tx) error {
+	if err := tx.DeleteBucket([]byte("Preds")); err != nil && err != bolt.ErrBucketNotFound {
+		return err
+	}
+	preds, err := tx.CreateBucket([]byte("Preds"))
+	if err != nil {
+		return err
+	}
+
+	b := tx.Bucket([]byte("Chain"))
+	rewrite := make(map[string][]byte)
+	err = b.ForEach(func(k, v []byte) error {
+		s, err := decodeSuffixes(v)
+		if err != nil {
+			return nil
+		}
+		buf, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(buf, v) {
+			rewrite[string(k)] = buf
+		}
+		for w, n := range s {
+			if err := addPred(preds, w, string(k), n); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for k, v := range rewrite {
+		if err := b.Put([]byte(k), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,323 @@
+package markov
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// topWordsLen is the number of most used words reported by Stats.
+const topWordsLen = 10
+
+// topWordsKeep is the number of most used words kept up to date in the Stats
+// bucket, more than reported so words dropping out of the top can be
+// replaced without walking the vocabulary.
+const topWordsKeep = 5 * topWordsLen
+
+// Stats describes the shape of the chain.
+type Stats struct {
+	Prefixes     int
+	Transitions  int
+	AvgBranching float64
+	MaxBranching int
+	Vocabulary   int
+	TopWords     []WordCount
+	// Chats maps chat IDs to the number of words learned from them.
+	Chats map[int64]int
+}
+
+// WordCount is a word and the number of times it was learned.
+type WordCount struct {
+	Word  string
+	Count int
+}
+
+// Stats returns statistics about the chain. Totals and top words are kept up
+// to date as messages are learned, so only the chats are walked to find their
+// sizes.
+func (c *Chain) Stats() (Stats, error) {
+	c.dbMutex.RLock()
+	defer c.dbMutex.RUnlock()
+
+	st := Stats{Chats: make(map[int64]int)}
+	err := c.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("Stats"))
+		st.Prefixes = getCount(b, "prefixes")
+		st.Transitions = getCount(b, "transitions")
+		st.MaxBranching = getCount(b, "maxbranch")
+		st.Vocabulary = getCount(b, "vocabulary")
+		if st.Prefixes > 0 {
+			st.AvgBranching = float64(st.Transitions) / float64(st.Prefixes)
+		}
+
+		st.TopWords = getTopWords(b)
+		if len(st.TopWords) > topWordsLen {
+			st.TopWords = st.TopWords[:topWordsLen]
+		}
+
+		return tx.Bucket([]byte("Chats")).ForEach(func(k, v []byte) error {
+			id, err := strconv.ParseInt(string(k), 10, 64)
+			if err != nil {
+				return nil
+			}
+			st.Chats[id], _ = strconv.Atoi(string(v))
+			return nil
+		})
+	})
+	return st, err
+}
+
+// statsDelta accumulates the changes to the statistics made while learning
+// a message, so they can be written in the same transaction.
+type statsDelta struct {
+	prefixes     int
+	transitions  int
+	maxBranching int
+	learned      int
+	words        map[string]int
+}
+
+func newStatsDelta() *statsDelta {
+	return &statsDelta{words: make(map[string]int)}
+}
+
+// learn records word being learned, and whether that created a new prefix or
+// a new transition, leaving the prefix with branches suffixes.
+func (d *statsDelta) learn(word string, newPrefix bool, newTransition bool, branches int) {
+	if newPrefix {
+		d.prefixes++
+	}
+	if newTransition {
+		d.transitions++
+	}
+	if branches > d.maxBranching {
+		d.maxBranching = branches
+	}
+	d.learned++
+	d.words[word]++
+}
+
+// unlearn records word being unlearned, and whether that removed its prefix
+// or its transition. The maximum branching is left as is, Check recomputes
+// it.
+func (d *statsDelta) unlearn(word string, removedPrefix bool, removedTransition bool) {
+	if removedPrefix {
+		d.prefixes--
+	}
+	if removedTransition {
+		d.transitions--
+	}
+	d.learned--
+	d.words[word]--
+}
+
+// write adds the delta to the statistics stored in tx, crediting the learned
+// words to chatID.
+func (d *statsDelta) write(tx *bolt.Tx, chatID int64) error {
+	if len(d.words) == 0 {
+		return nil
+	}
+
+	b := tx.Bucket([]byte("Stats"))
+	words := tx.Bucket([]byte("Words"))
+	top := getTopWords(b)
+	var vocabulary int
+	for w, n := range d.words {
+		count := getCount(words, w)
+		switch {
+		case n == 0, count == 0 && n < 0:
+			continue
+		case count+n <= 0:
+			vocabulary--
+			top = updateTopWords(top, w, 0)
+			if err := words.Delete([]byte(w)); err != nil {
+				return err
+			}
+			continue
+		case count == 0:
+			vocabulary++
+		}
+		top = updateTopWords(top, w, count+n)
+		if err := putCount(words, w, count+n); err != nil {
+			return err
+		}
+	}
+	if err := putTopWords(b, top); err != nil {
+		return err
+	}
+
+	chats := tx.Bucket([]byte("Chats"))
+	chat := strconv.FormatInt(chatID, 10)
+	if n := getCount(chats, chat) + d.learned; n > 0 {
+		if err := putCount(chats, chat, n); err != nil {
+			return err
+		}
+	} else if err := chats.Delete([]byte(chat)); err != nil {
+		return err
+	}
+
+	if err := putCount(b, "prefixes", getCount(b, "prefixes")+d.prefixes); err != nil {
+		return err
+	}
+	if err := putCount(b, "transitions", getCount(b, "transitions")+d.transitions); err != nil {
+		return err
+	}
+	if err := putCount(b, "vocabulary", getCount(b, "vocabulary")+vocabulary); err != nil {
+		return err
+	}
+	if d.maxBranching > getCount(b, "maxbranch") {
+		return putCount(b, "maxbranch", d.maxBranching)
+	}
+	return nil
+}
+
+// chainCounts are the statistics of the chain bucket, computed by walking it.
+type chainCounts struct {
+	prefixes     int
+	transitions  int
+	maxBranching int
+	// words sums the weights of the transitions to each word.
+	words map[string]int
+}
+
+// countChain walks the whole chain bucket to compute its statistics. It is
+// used to build the counters of state files that predate them and by Check.
+func countChain(b *bolt.Bucket) chainCounts {
+	cc := chainCounts{words: make(map[string]int)}
+	b.ForEach(func(k, v []byte) error {
+		choices, err := decodeSuffixes(v)
+		if err != nil {
+			return nil
+		}
+		cc.prefixes++
+		cc.transitions += len(choices)
+		if len(choices) > cc.maxBranching {
+			cc.maxBranching = len(choices)
+		}
+		for w, n := range choices {
+			cc.words[w] += n
+		}
+		return nil
+	})
+	return cc
+}
+
+// initStats creates the statistics buckets, building them from the chain if
+// they were missing.
+func (c *Chain) initStats(tx *bolt.Tx) error {
+	if b := tx.Bucket([]byte("Stats")); b != nil {
+		if b.Get([]byte("topwords")) != nil {
+			return nil
+		}
+		// statistics from before the top words were kept
+		var top []WordCount
+		err := tx.Bucket([]byte("Words")).ForEach(func(k, v []byte) error {
+			n, _ := strconv.Atoi(string(v))
+			top = updateTopWords(top, string(k), n)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return putTopWords(b, top)
+	}
+
+	if k, _ := tx.Bucket([]byte("Chain")).Cursor().First(); k != nil {
+		c.log.Warnf("State file has no statistics, building them from the chain")
+	}
+	return buildStats(tx)
+}
+
+// buildStats creates the statistics buckets and fills them from the chain.
+// The words learned from each chat cannot be recovered from the chain, they
+// are left as they are.
+func buildStats(tx *bolt.Tx) error {
+	for _, name := range []string{"Stats", "Words", "Chats"} {
+		if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+			return err
+		}
+	}
+
+	cc := countChain(tx.Bucket([]byte("Chain")))
+	words := tx.Bucket([]byte("Words"))
+	var top []WordCount
+	for w, n := range cc.words {
+		if err := putCount(words, w, n); err != nil {
+			return err
+		}
+		top = updateTopWords(top, w, n)
+	}
+	b := tx.Bucket([]byte("Stats"))
+	if err := putTopWords(b, top); err != nil {
+		return err
+	}
+	for k, v := range map[string]int{
+		"prefixes":    cc.prefixes,
+		"transitions": cc.transitions,
+		"maxbranch":   cc.maxBranching,
+		"vocabulary":  len(cc.words),
+	} {
+		if err := putCount(b, k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateTopWords sets the count of w in top, the most used words sorted by
+// count then alphabetically, dropping it if it falls out of the kept ones. Short words are
+// mostly articles and the like, they are skipped the same way GenerateChain
+// does when picking a seed.
+func updateTopWords(top []WordCount, w string, n int) []WordCount {
+	if len(w) <= 3 {
+		return top
+	}
+	for i := range top {
+		if top[i].Word == w {
+			top = append(top[:i], top[i+1:]...)
+			break
+		}
+	}
+	// before returns true if w with n comes before wc
+	before := func(wc WordCount) bool {
+		return wc.Count < n || wc.Count == n && wc.Word > w
+	}
+	if n <= 0 || len(top) >= topWordsKeep && !before(top[len(top)-1]) {
+		return top
+	}
+	i := sort.Search(len(top), func(i int) bool { return before(top[i]) })
+	top = append(top, WordCount{})
+	copy(top[i+1:], top[i:])
+	top[i] = WordCount{Word: w, Count: n}
+	if len(top) > topWordsKeep {
+		top = top[:topWordsKeep]
+	}
+	return top
+}
+
+func getTopWords(b *bolt.Bucket) []WordCount {
+	var top []WordCount
+	if v := b.Get([]byte("topwords")); v != nil {
+		json.Unmarshal(v, &top)
+	}
+	return top
+}
+
+func putTopWords(b *bolt.Bucket, top []WordCount) error {
+	buf, err := json.Marshal(top)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte("topwords"), buf)
+}
+
+func getCount(b *bolt.Bucket, key string) int {
+	n, _ := strconv.Atoi(string(b.Get([]byte(key))))
+	return n
+}
+
+func putCount(b *bolt.Bucket, key string, n int) error {
+	return b.Put([]byte(key), []byte(strconv.Itoa(n)))
+}
@@ -0,0 +1,19 @@
+package markov
+
+// Trace records how GenerateChainTrace built a reply.
+type Trace struct {
+	// Seed is the text the reply was generated from.
+	Seed string
+	// Candidates are the words of the seed that were considered to start
+	// the reply with, and Chosen the one that was picked, if any.
+	Candidates []string
+	Chosen     string
+	Steps      []Step
+}
+
+// Step is a word picked while generating a reply.
+type Step struct {
+	Prefix  string
+	Choices int
+	Word    string
+}
@@ -0,0 +1,113 @@
+package nocino
+
+import (
+	"sync"
+	"time"
+
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+// adminsTTL is how long the administrators of a chat are cached before
+// asking Telegram again, so promotions and demotions are picked up.
+// adminsErrTTL is how long a failure to fetch them is, so a chat we cannot
+// ask about does not turn every command into a request.
+const (
+	adminsTTL    = 10 * time.Minute
+	adminsErrTTL = time.Minute
+)
+
+// Admins caches the administrators of the chats we are in.
+type Admins struct {
+	api   *tgbotapi.BotAPI
+	mutex sync.Mutex
+	chats map[int64]*chatAdmins
+}
+
+// chatAdmins are the administrators of a chat, available once done is
+// closed.
+type chatAdmins struct {
+	ids     map[int]bool
+	err     error
+	fetched time.Time
+	done    chan struct{}
+}
+
+func (c *chatAdmins) expired(now time.Time) bool {
+	if c.err != nil {
+		return now.Sub(c.fetched) >= adminsErrTTL
+	}
+	return now.Sub(c.fetched) >= adminsTTL
+}
+
+func NewAdmins(api *tgbotapi.BotAPI) *Admins {
+	return &Admins{
+		api:   api,
+		chats: make(map[int64]*chatAdmins),
+	}
+}
+
+// IsAdmin returns true if userID administers chatID, fetching the
+// administrators of the chat with GetChatAdministrators when the cached ones
+// expired. Concurrent calls for a chat share a single fetch.
+func (a *Admins) IsAdmin(chatID int64, userID int) (bool, error) {
+	now := time.Now()
+	a.mutex.Lock()
+	c, ok := a.chats[chatID]
+	if ok {
+		select {
+		case <-c.done:
+			if c.expired(now) {
+				ok = false
+			}
+		default:
+			// being fetched
+		}
+	}
+	if !ok {
+		c = &chatAdmins{done: make(chan struct{})}
+		a.chats[chatID] = c
+		a.prune(now)
+		a.mutex.Unlock()
+		a.fetch(chatID, c)
+	} else {
+		a.mutex.Unlock()
+		<-c.done
+	}
+
+	if c.err != nil {
+		return false, c.err
+	}
+	return c.ids[userID], nil
+}
+
+// fetch asks Telegram for the administrators of chatID, and makes them
+// available in c.
+func (a *Admins) fetch(chatID int64, c *chatAdmins) {
+	defer close(c.done)
+	members, err := a.api.GetChatAdministrators(tgbotapi.ChatConfig{ChatID: chatID})
+	c.fetched = time.Now()
+	if err != nil {
+		c.err = err
+		return
+	}
+	c.ids = make(map[int]bool)
+	for _, m := range members {
+		if m.User != nil {
+			c.ids[m.User.ID] = true
+		}
+	}
+}
+
+// prune drops the chats whose administrators expired, so chats we left do
+// not stay around forever.
+func (a *Admins) prune(now time.Time) {
+	for id, c := range a.chats {
+		select {
+		case <-c.done:
+			if c.expired(now) {
+				delete(a.chats, id)
+			}
+		default:
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package nocino
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// maxBlocked is the number of entries a blocklist can have.
+const maxBlocked = 200
+
+// ErrTooManyBlocked is returned when a blocklist would have more than
+// maxBlocked entries.
+var ErrTooManyBlocked = fmt.Errorf("a blocklist can have at most %d entries", maxBlocked)
+
+// BlockKind is how a blocklist entry matches words.
+type BlockKind string
+
+const (
+	// BlockWord matches the word itself.
+	BlockWord BlockKind = "word"
+	// BlockStem matches the words starting with the pattern.
+	BlockStem BlockKind = "stem"
+	// BlockRegex matches the words matching the pattern.
+	BlockRegex BlockKind = "regex"
+)
+
+// BlockEntry is a word, stem or regular expression the bot must never learn
+// nor say.
+type BlockEntry struct {
+	Pattern string
+	Kind    BlockKind
+	re      *regexp.Regexp
+}
+
+// ParseBlockEntry parses "word", "stem*" or "/regex/" into an entry.
+func ParseBlockEntry(s string) (BlockEntry, error) {
+	s = strings.TrimSpace(s)
+	var e BlockEntry
+	switch {
+	case len(s) > 2 && strings.HasPrefix(s, "/") && strings.HasSuffix(s, "/"):
+		e = BlockEntry{Pattern: s[1 : len(s)-1], Kind: BlockRegex}
+	case len(s) > 1 && strings.HasSuffix(s, "*"):
+		e = BlockEntry{Pattern: normalizeWord(strings.TrimSuffix(s, "*")), Kind: BlockStem}
+	default:
+		e = BlockEntry{Pattern: normalizeWord(s), Kind: BlockWord}
+	}
+	if e.Pattern == "" {
+		return e, fmt.Errorf("nothing to block in '%s'", s)
+	}
+	if err := e.compile(); err != nil {
+		return e, err
+	}
+	return e, nil
+}
+
+func (e *BlockEntry) compile() error {
+	if e.Kind != BlockRegex || e.re != nil {
+		return nil
+	}
+	re, err := regexp.Compile("(?i)" + e.Pattern)
+	if err != nil {
+		return err
+	}
+	e.re = re
+	return nil
+}
+
+// Match returns true if word is blocked by the entry.
+func (e BlockEntry) Match(word string) bool {
+	word = normalizeWord(word)
+	if word == "" {
+		return false
+	}
+	switch e.Kind {
+	case BlockStem:
+		return strings.HasPrefix(word, e.Pattern)
+	case BlockRegex:
+		return e.re != nil && e.re.MatchString(word)
+	}
+	return word == e.Pattern
+}
+
+func (e BlockEntry) String() string {
+	switch e.Kind {
+	case BlockStem:
+		return e.Pattern + "*"
+	case BlockRegex:
+		return "/" + e.Pattern + "/"
+	}
+	return e.Pattern
+}
+
+// normalizeWord lowercases word and trims the punctuation around it, so
+// "Word!" is blocked like "word".
+func normalizeWord(word string) string {
+	return strings.ToLower(strings.TrimFunc(word, func(r rune) bool {
+		return unicode.IsPunct(r) || unicode.IsSpace(r)
+	}))
+}
+
+// Blocklist holds the words blocked everywhere, stored under chat ID 0, and
+// the ones blocked in single chats. It caches the compiled entries of the
+// chats it was asked about.
+type Blocklist struct {
+	store *Store
+	mutex sync.RWMutex
+	cache map[int64][]BlockEntry
+	// gen counts the changes to the blocklist.
+	gen uint64
+}
+
+// NewBlocklist returns the blocklist stored in store.
+func NewBlocklist(store *Store) *Blocklist {
+	return &Blocklist{
+		store: store,
+		cache: make(map[int64][]BlockEntry),
+	}
+}
+
+// Entries returns the entries blocked in chatID, or everywhere if chatID is
+// 0.
+func (b *Blocklist) Entries(chatID int64) ([]BlockEntry, error) {
+	b.mutex.RLock()
+	entries, ok := b.cache[chatID]
+	gen := b.gen
+	b.mutex.RUnlock()
+	if ok {
+		return entries, nil
+	}
+
+	if _, err := b.store.get("Blocklist", chatID, &entries); err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		if err := entries[i].compile(); err != nil {
+			b.store.log.Warnf("Skipping invalid blocklist regex '%s': '%s'", entries[i].Pattern, err)
+		}
+	}
+	b.mutex.Lock()
+	// unless changed meanwhile, and what we read may be stale
+	if b.gen == gen {
+		b.cache[chatID] = entries
+	}
+	b.mutex.Unlock()
+	return entries, nil
+}
+
+// Add blocks e in chatID, or everywhere if chatID is 0. It returns false if
+// it was already blocked.
+func (b *Blocklist) Add(chatID int64, e BlockEntry) (bool, error) {
+	entries, err := b.Entries(chatID)
+	if err != nil {
+		return false, err
+	}
+	for _, old := range entries {
+		if old.Kind == e.Kind && old.Pattern == e.Pattern {
+			return false, nil
+		}
+	}
+	if len(entries) >= maxBlocked {
+		return false, ErrTooManyBlocked
+	}
+	updated := append(append([]BlockEntry(nil), entries...), e)
+	return true, b.set(chatID, updated)
+}
+
+// Remove unblocks e in chatID, or everywhere if chatID is 0. It returns false
+// if it was not blocked.
+func (b *Blocklist) Remove(chatID int64, e BlockEntry) (bool, error) {
+	entries, err := b.Entries(chatID)
+	if err != nil {
+		return false, err
+	}
+	var updated []BlockEntry
+	for _, old := range entries {
+		if old.Kind != e.Kind || old.Pattern != e.Pattern {
+			updated = append(updated, old)
+		}
+	}
+	if len(updated) == len(entries) {
+		return false, nil
+	}
+	return true, b.set(chatID, updated)
+}
+
+func (b *Blocklist) set(chatID int64, entries []BlockEntry) error {
+	var err error
+	if len(entries) == 0 {
+		err = b.store.delete("Blocklist", chatID)
+	} else {
+		err = b.store.put("Blocklist", chatID, entries)
+	}
+	b.mutex.Lock()
+	delete(b.cache, chatID)
+	b.gen++
+	b.mutex.Unlock()
+	return err
+}
+
+// Blocked returns true if word is blocked everywhere or in chatID.
+func (b *Blocklist) Blocked(chatID int64, word string) bool {
+	chats := []int64{0}
+	if chatID != 0 {
+		chats = append(chats, chatID)
+	}
+	for _, id := range chats {
+		entries, err := b.Entries(id)
+		if err != nil {
+			b.store.log.Errorf("Cannot load blocklist: '%s'", err)
+			continue
+		}
+		for _, e := range entries {
+			if e.Match(word) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Contains returns the first word of text blocked in chatID, if any.
+func (b *Blocklist) Contains(chatID int64, text string) (string, bool) {
+	for _, w := range strings.Fields(text) {
+		if b.Blocked(chatID, w) {
+			return w, true
+		}
+	}
+	return "", false
+}
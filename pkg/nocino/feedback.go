@@ -0,0 +1,47 @@
+package nocino
+
+import (
+	"encoding/json"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Feedback counts the votes given to the replies of a chat.
+type Feedback struct {
+	Up   int
+	Down int
+}
+
+// Feedback returns the votes given to the replies of chatID.
+func (s *Store) Feedback(chatID int64) (Feedback, error) {
+	var f Feedback
+	_, err := s.get("Feedback", chatID, &f)
+	return f, err
+}
+
+// AddFeedback replaces the vote prev of a user on a reply in chatID with
+// vote, 1 for good, -1 for bad and 0 for none.
+func (s *Store) AddFeedback(chatID int64, prev int, vote int) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("Feedback"))
+		var f Feedback
+		if buf := b.Get(chatKey(chatID)); buf != nil {
+			if err := json.Unmarshal(buf, &f); err != nil {
+				return err
+			}
+		}
+		for _, v := range []struct{ vote, n int }{{prev, -1}, {vote, 1}} {
+			switch v.vote {
+			case 1:
+				f.Up += v.n
+			case -1:
+				f.Down += v.n
+			}
+		}
+		buf, err := json.Marshal(f)
+		if err != nil {
+			return err
+		}
+		return b.Put(chatKey(chatID), buf)
+	})
+}
@@ -0,0 +1,98 @@
+package nocino
+
+import (
+	"sync"
+	"time"
+)
+
+// ActivityWindow is how far back chat activity is looked at when deciding
+// whether to interject.
+const ActivityWindow = 10 * time.Minute
+
+// Interjection configures unprompted replies to ordinary group messages.
+type Interjection struct {
+	// Probability of replying to a message, 0 disables interjections.
+	Probability float64
+	// Cooldown is the minimum time between two interjections in a chat.
+	Cooldown time.Duration
+	// MinMessages and MinUsers are the number of messages, and of people
+	// sending them, needed in the last ActivityWindow to interject.
+	MinMessages int
+	MinUsers    int
+}
+
+type message struct {
+	userID int
+	at     time.Time
+}
+
+type chatActivity struct {
+	messages    []message
+	interjected time.Time
+}
+
+// Activity tracks recent messages in group chats.
+type Activity struct {
+	mutex sync.Mutex
+	chats map[int64]*chatActivity
+}
+
+func NewActivity() *Activity {
+	return &Activity{
+		chats: make(map[int64]*chatActivity),
+	}
+}
+
+// chat returns the activity of chatID, dropping messages older than
+// ActivityWindow. It must be called with the mutex held.
+func (a *Activity) chat(chatID int64, now time.Time) *chatActivity {
+	ca, ok := a.chats[chatID]
+	if !ok {
+		ca = &chatActivity{}
+		a.chats[chatID] = ca
+	}
+	i := 0
+	for i < len(ca.messages) && now.Sub(ca.messages[i].at) > ActivityWindow {
+		i++
+	}
+	ca.messages = ca.messages[i:]
+	return ca
+}
+
+// Record records a message sent by userID in chatID.
+func (a *Activity) Record(chatID int64, userID int, at time.Time) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	ca := a.chat(chatID, at)
+	ca.messages = append(ca.messages, message{userID: userID, at: at})
+}
+
+// Recent returns the number of messages, and of people sending them, in
+// chatID in the last ActivityWindow.
+func (a *Activity) Recent(chatID int64) (messages int, users int) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	ca := a.chat(chatID, time.Now())
+	seen := make(map[int]bool)
+	for _, m := range ca.messages {
+		seen[m.userID] = true
+	}
+	return len(ca.messages), len(seen)
+}
+
+// TryInterject records an interjection in chatID and returns true, unless
+// the last one was less than cooldown ago.
+func (a *Activity) TryInterject(chatID int64, cooldown time.Duration) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	now := time.Now()
+	ca := a.chat(chatID, now)
+	if now.Sub(ca.interjected) < cooldown {
+		return false
+	}
+	ca.interjected = now
+	return true
+}
@@ -4,27 +4,41 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/frapposelli/nocino/pkg/gif"
+	"github.com/frapposelli/nocino/pkg/markov"
 
 	"github.com/sirupsen/logrus"
-	"go.etcd.io/bbolt"
-	bolt "go.etcd.io/bbolt"
 	tgbotapi "gopkg.in/telegram-bot-api.v4"
 )
 
 type Nocino struct {
 	API         *tgbotapi.BotAPI
 	BotUsername string
-	Numw        int
 	Plen        int
 	GIFmaxsize  int
 	TrustedMap  map[int]bool
-	Log         *logrus.Entry
+	BackupDir   string
+	Replies     *Replies
+	Store       *Store
+	Activity    *Activity
+	Limiter     *Limiter
+	Outbox      *Outbox
+	Blocklist   *Blocklist
+	Admins      *Admins
+	// Defaults are the settings of chats that did not change them.
+	Defaults ChatSettings
+	Log      *logrus.Entry
+	// triggers caches the compiled triggers of chats. triggersGen counts the
+	// changes to them.
+	triggersMutex sync.RWMutex
+	triggers      map[int64][]Trigger
+	triggersGen   uint64
 }
 
-func NewNocino(tgtoken string, trustedIDs string, numw int, plen int, gifmaxsize int, logger *logrus.Logger) *Nocino {
+func NewNocino(tgtoken string, trustedIDs string, plen int, gifmaxsize int, backupdir string, store *Store, defaults ChatSettings, logger *logrus.Logger) *Nocino {
 	trustedMap := make(map[int]bool)
 	if trustedIDs != "" {
 		ids := strings.Split(trustedIDs, ",")
@@ -45,30 +59,33 @@ func NewNocino(tgtoken string, trustedIDs string, numw int, plen int, gifmaxsize
 	return &Nocino{
 		API:         bot,
 		BotUsername: botUsername,
-		Numw:        numw,
 		Plen:        plen,
 		GIFmaxsize:  gifmaxsize,
 		TrustedMap:  trustedMap,
+		BackupDir:   backupdir,
+		Replies:     NewReplies(),
+		Store:       store,
+		Activity:    NewActivity(),
+		Limiter:     NewLimiter(),
+		Outbox:      NewOutbox(bot, store, logger),
+		Blocklist:   NewBlocklist(store),
+		Admins:      NewAdmins(bot),
+		Defaults:    defaults,
 		Log:         logfields,
+		triggers:    make(map[int64][]Trigger),
 	}
 }
 
-func (n *Nocino) RunStatsTicker(markov *bbolt.DB, gifdb *gif.GIFDB) {
+func (n *Nocino) RunStatsTicker(mchain *markov.Chain, gifdb *gif.GIFDB) {
 	ticker := time.NewTicker(10 * time.Minute)
 	go func() {
 		for range ticker.C {
-			bucketStats := 0
-			err := markov.View(func(tx *bolt.Tx) error {
-				b := tx.Bucket([]byte("Chain"))
-				if b != nil {
-					bucketStats = b.Stats().KeyN
-				}
-				return nil
-			})
+			st, err := mchain.Stats()
 			if err != nil {
-				n.Log.Errorf("boltdb transaction failed with: '%s'", err)
+				n.Log.Errorf("Cannot get chain stats: '%s'", err)
+				continue
 			}
-			n.Log.Infof("Nocino Stats: %d Markov suffixes, %d GIF in Database", bucketStats, len(gifdb.List))
+			n.Log.Infof("Nocino Stats: %d Markov prefixes, %d transitions, %d words, %d GIF in Database", st.Prefixes, st.Transitions, st.Vocabulary, len(gifdb.List))
 		}
 	}()
 }
@@ -0,0 +1,56 @@
+package nocino
+
+import (
+	"strconv"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// optOutKey returns the key of an opt-out in the OptOut bucket: the user ID
+// for everywhere, the user and chat IDs for a single chat. Chat entries
+// override the global one, so a user can opt out everywhere but in a few
+// chats.
+func optOutKey(userID int, chatID int64, global bool) []byte {
+	if global {
+		return []byte(strconv.Itoa(userID))
+	}
+	return []byte(strconv.Itoa(userID) + ":" + strconv.FormatInt(chatID, 10))
+}
+
+// OptedOut returns true if userID does not want to be learned from in
+// chatID.
+func (s *Store) OptedOut(userID int, chatID int64) (bool, error) {
+	var out bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("OptOut"))
+		v := b.Get(optOutKey(userID, chatID, false))
+		if v == nil {
+			v = b.Get(optOutKey(userID, chatID, true))
+		}
+		out = string(v) == "out"
+		return nil
+	})
+	return out, err
+}
+
+// SetOptOut records whether userID wants to be learned from, in chatID or
+// everywhere if global. Opting in or out everywhere drops the choice made for
+// chatID.
+func (s *Store) SetOptOut(userID int, chatID int64, global bool, out bool) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("OptOut"))
+		if global {
+			if err := b.Delete(optOutKey(userID, chatID, false)); err != nil {
+				return err
+			}
+			if !out {
+				return b.Delete(optOutKey(userID, chatID, true))
+			}
+		}
+		v := "in"
+		if out {
+			v = "out"
+		}
+		return b.Put(optOutKey(userID, chatID, global), []byte(v))
+	})
+}
@@ -0,0 +1,256 @@
+package nocino
+
+import (
+	"errors"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+const (
+	// queueLen is the number of messages that can wait to be sent to a chat.
+	queueLen = 100
+	// queueIdle is how long the worker of an empty queue waits for more
+	// messages before exiting.
+	queueIdle = time.Minute
+	// maxAttempts is the number of times a message is tried before giving up.
+	maxAttempts = 5
+	maxBackoff  = 30 * time.Second
+
+	// Telegram allows about 30 messages per second overall, one per second
+	// in a private chat and 20 per minute in a group.
+	globalInterval  = time.Second / 30
+	privateInterval = time.Second
+	groupInterval   = 3 * time.Second
+)
+
+var (
+	// ErrQueueFull is returned when too many messages are waiting to be sent
+	// to a chat.
+	ErrQueueFull = errors.New("send queue is full")
+	// ErrChatInactive is returned when sending to a chat we can no longer
+	// send to.
+	ErrChatInactive = errors.New("chat is inactive")
+)
+
+// retryAfterRe matches the description of 429 errors returned by uploads,
+// which are not decoded into a tgbotapi.Error.
+var retryAfterRe = regexp.MustCompile(`retry after (\d+)`)
+
+type outgoing struct {
+	msg    tgbotapi.Chattable
+	result chan sendResult
+}
+
+type sendResult struct {
+	sent tgbotapi.Message
+	err  error
+}
+
+// inactiveChat is stored for chats we cannot send to anymore.
+type inactiveChat struct {
+	Reason string
+	Since  time.Time
+}
+
+// Outbox sends messages through a queue per chat, so replies to a chat go out
+// in order and within Telegram limits, retrying the ones that fail for
+// transient reasons.
+type Outbox struct {
+	api   *tgbotapi.BotAPI
+	store *Store
+	log   *logrus.Entry
+
+	mutex  sync.Mutex
+	queues map[int64]chan *outgoing
+	// next is the earliest time the next message can be sent to any chat.
+	next time.Time
+}
+
+func NewOutbox(api *tgbotapi.BotAPI, store *Store, logger *logrus.Logger) *Outbox {
+	return &Outbox{
+		api:    api,
+		store:  store,
+		log:    logger.WithField("component", "outbox"),
+		queues: make(map[int64]chan *outgoing),
+	}
+}
+
+// Send queues msg for chatID and waits for it to be sent.
+func (o *Outbox) Send(chatID int64, msg tgbotapi.Chattable) (tgbotapi.Message, error) {
+	if o.Inactive(chatID) {
+		o.log.Debugf("Not sending to inactive chat %d", chatID)
+		return tgbotapi.Message{}, ErrChatInactive
+	}
+
+	out := &outgoing{msg: msg, result: make(chan sendResult, 1)}
+	o.mutex.Lock()
+	q, ok := o.queues[chatID]
+	if !ok {
+		q = make(chan *outgoing, queueLen)
+		o.queues[chatID] = q
+		go o.run(chatID, q)
+	}
+	select {
+	case q <- out:
+	default:
+		o.mutex.Unlock()
+		o.log.Warnf("Send queue of chat %d is full, dropping message", chatID)
+		return tgbotapi.Message{}, ErrQueueFull
+	}
+	o.mutex.Unlock()
+
+	res := <-out.result
+	return res.sent, res.err
+}
+
+// run sends the messages queued for chatID, one at a time, until the queue
+// stays empty for queueIdle.
+func (o *Outbox) run(chatID int64, q chan *outgoing) {
+	interval := privateInterval
+	if chatID < 0 {
+		interval = groupInterval
+	}
+
+	var last time.Time
+	for {
+		select {
+		case out := <-q:
+			time.Sleep(time.Until(last.Add(interval)))
+			sent, err := o.send(chatID, out.msg)
+			last = time.Now()
+			out.result <- sendResult{sent, err}
+		case <-time.After(queueIdle):
+			o.mutex.Lock()
+			if len(q) == 0 {
+				delete(o.queues, chatID)
+				o.mutex.Unlock()
+				return
+			}
+			o.mutex.Unlock()
+		}
+	}
+}
+
+// send sends msg, retrying transient failures with exponential backoff and
+// waiting as long as Telegram asks when rate limited.
+func (o *Outbox) send(chatID int64, msg tgbotapi.Chattable) (tgbotapi.Message, error) {
+	backoff := time.Second
+	var err error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if o.Inactive(chatID) {
+			return tgbotapi.Message{}, ErrChatInactive
+		}
+		o.wait()
+
+		var sent tgbotapi.Message
+		sent, err = o.api.Send(msg)
+		if err == nil {
+			return sent, nil
+		}
+
+		if retryAfter := retryAfter(err); retryAfter > 0 {
+			o.log.Warnf("Rate limited by Telegram sending to chat %d, retrying in %s", chatID, retryAfter)
+			time.Sleep(retryAfter)
+			continue
+		}
+		if permanent(err) {
+			o.log.Errorf("Cannot send to chat %d: '%s'", chatID, err)
+			if chatGone(err) {
+				o.deactivate(chatID, err.Error())
+			}
+			return tgbotapi.Message{}, err
+		}
+
+		o.log.Warnf("Sending to chat %d failed (attempt %d of %d), retrying in %s: '%s'", chatID, attempt, maxAttempts, backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+	o.log.Errorf("Giving up sending to chat %d after %d attempts: '%s'", chatID, maxAttempts, err)
+	return tgbotapi.Message{}, err
+}
+
+// wait blocks until another message can be sent without exceeding the global
+// rate.
+func (o *Outbox) wait() {
+	o.mutex.Lock()
+	now := time.Now()
+	at := o.next
+	if at.Before(now) {
+		at = now
+	}
+	o.next = at.Add(globalInterval)
+	o.mutex.Unlock()
+
+	time.Sleep(time.Until(at))
+}
+
+// Inactive returns true if chatID was marked inactive after a permanent
+// failure.
+func (o *Outbox) Inactive(chatID int64) bool {
+	var chat inactiveChat
+	found, err := o.store.get("Inactive", chatID, &chat)
+	if err != nil {
+		o.log.Errorf("Cannot check whether chat %d is inactive: '%s'", chatID, err)
+	}
+	return found
+}
+
+// Activate marks chatID active again, for when we hear from it after it was
+// marked inactive.
+func (o *Outbox) Activate(chatID int64) {
+	if !o.Inactive(chatID) {
+		return
+	}
+	o.log.Infof("Chat %d is active again", chatID)
+	if err := o.store.delete("Inactive", chatID); err != nil {
+		o.log.Errorf("Cannot mark chat %d active: '%s'", chatID, err)
+	}
+}
+
+func (o *Outbox) deactivate(chatID int64, reason string) {
+	o.log.Warnf("Marking chat %d inactive: '%s'", chatID, reason)
+	if err := o.store.put("Inactive", chatID, inactiveChat{Reason: reason, Since: time.Now()}); err != nil {
+		o.log.Errorf("Cannot mark chat %d inactive: '%s'", chatID, err)
+	}
+}
+
+// retryAfter returns how long Telegram asked us to wait, if err is a 429.
+func retryAfter(err error) time.Duration {
+	var tgErr tgbotapi.Error
+	if errors.As(err, &tgErr) && tgErr.RetryAfter > 0 {
+		return time.Duration(tgErr.RetryAfter) * time.Second
+	}
+	if m := retryAfterRe.FindStringSubmatch(err.Error()); m != nil {
+		n, _ := strconv.Atoi(m[1])
+		return time.Duration(n) * time.Second
+	}
+	return 0
+}
+
+// permanent returns true if retrying err is pointless: Telegram understood
+// the request and refused it.
+func permanent(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return false
+	}
+	msg := err.Error()
+	return strings.HasPrefix(msg, "Bad Request") || strings.HasPrefix(msg, "Forbidden") ||
+		strings.HasPrefix(msg, "Unauthorized") || strings.HasPrefix(msg, "Not Found")
+}
+
+// chatGone returns true if err means we cannot send to the chat anymore, like
+// when the bot was kicked or blocked.
+func chatGone(err error) bool {
+	msg := err.Error()
+	return strings.HasPrefix(msg, "Forbidden") || strings.Contains(msg, "chat not found")
+}
@@ -0,0 +1,121 @@
+package nocino
+
+import (
+	"sync"
+	"time"
+)
+
+// maxBuckets is the number of token buckets kept by Limiter before the ones
+// unused for bucketTTL are dropped.
+const (
+	maxBuckets = 10000
+	bucketTTL  = time.Hour
+)
+
+// RateLimit limits how often the bot replies, with token buckets refilling
+// at a rate per minute up to a burst. A rate of 0 disables the limit.
+type RateLimit struct {
+	ChatRate  float64
+	ChatBurst int
+	UserRate  float64
+	UserBurst int
+	// CalmDown tells users the first time they are limited, instead of
+	// ignoring them silently.
+	CalmDown bool
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	// limited is set when a request is denied, and cleared when one is
+	// allowed again.
+	limited bool
+}
+
+// Limiter keeps token buckets for chats and users.
+type Limiter struct {
+	// mutex guards buckets, refill and prune expect it held.
+	mutex   sync.Mutex
+	buckets map[interface{}]*bucket
+}
+
+func NewLimiter() *Limiter {
+	return &Limiter{
+		buckets: make(map[interface{}]*bucket),
+	}
+}
+
+type chatLimitKey int64
+
+type userLimitKey struct {
+	chatID int64
+	userID int
+}
+
+// Allow takes a token from the bucket of chatID and, unless userID is 0, from
+// the bucket of userID in chatID. Tokens are only taken when both buckets
+// have one, so a user is not charged for replies the chat limit denies.
+// userLimited is true if the user bucket was empty, and first if this is the
+// first request of the user denied since they were last allowed.
+func (l *Limiter) Allow(chatID int64, userID int, rl RateLimit) (allowed bool, userLimited bool, first bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	var user *bucket
+	if userID != 0 {
+		user = l.refill(userLimitKey{chatID, userID}, rl.UserRate, rl.UserBurst, now)
+	}
+	chat := l.refill(chatLimitKey(chatID), rl.ChatRate, rl.ChatBurst, now)
+
+	if user != nil && user.tokens < 1 {
+		first = !user.limited
+		user.limited = true
+		return false, true, first
+	}
+	if chat != nil && chat.tokens < 1 {
+		return false, false, false
+	}
+	for _, b := range []*bucket{user, chat} {
+		if b != nil {
+			b.tokens--
+			b.limited = false
+		}
+	}
+	return true, false, false
+}
+
+// refill returns the bucket of key with the tokens earned since it was last
+// used, or nil if rate disables the limit.
+func (l *Limiter) refill(key interface{}, rate float64, burst int, now time.Time) *bucket {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxBuckets {
+			l.prune(now)
+		}
+		b = &bucket{tokens: float64(burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Minutes() * rate
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+	return b
+}
+
+// prune drops the buckets unused for bucketTTL.
+func (l *Limiter) prune(now time.Time) {
+	for k, b := range l.buckets {
+		if now.Sub(b.last) > bucketTTL {
+			delete(l.buckets, k)
+		}
+	}
+}
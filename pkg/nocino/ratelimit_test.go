@@ -0,0 +1,94 @@
+package nocino
+
+import "testing"
+
+// slow refills so slowly that no token comes back while a test runs.
+const slow = 1e-9
+
+func TestLimiterAllow(t *testing.T) {
+	type call struct {
+		chatID      int64
+		userID      int
+		rl          RateLimit
+		allowed     bool
+		userLimited bool
+		first       bool
+	}
+	userOnly := RateLimit{UserRate: slow, UserBurst: 1}
+	chatOnly := RateLimit{ChatRate: slow, ChatBurst: 1}
+	both := RateLimit{ChatRate: slow, ChatBurst: 1, UserRate: slow, UserBurst: 1}
+	tests := []struct {
+		name  string
+		calls []call
+	}{
+		{
+			name: "unlimited",
+			calls: []call{
+				{1, 10, RateLimit{}, true, false, false},
+				{1, 10, RateLimit{}, true, false, false},
+				{1, 10, RateLimit{}, true, false, false},
+			},
+		},
+		{
+			name: "user told once",
+			calls: []call{
+				{1, 10, userOnly, true, false, false},
+				{1, 10, userOnly, false, true, true},
+				{1, 10, userOnly, false, true, false},
+				{1, 20, userOnly, true, false, false},
+			},
+		},
+		{
+			name: "users are limited per chat",
+			calls: []call{
+				{1, 10, userOnly, true, false, false},
+				{2, 10, userOnly, true, false, false},
+			},
+		},
+		{
+			name: "chat limit",
+			calls: []call{
+				{1, 10, chatOnly, true, false, false},
+				{1, 20, chatOnly, false, false, false},
+				{2, 20, chatOnly, true, false, false},
+			},
+		},
+		{
+			name: "user not charged when the chat is limited",
+			calls: []call{
+				{1, 10, both, true, false, false},
+				{1, 20, both, false, false, false},
+				// with the chat limit lifted, user 20 still has its token
+				{1, 20, userOnly, true, false, false},
+			},
+		},
+		{
+			name: "chat not charged when the user is limited",
+			calls: []call{
+				{1, 10, userOnly, true, false, false},
+				{1, 10, both, false, true, true},
+				{1, 20, both, true, false, false},
+			},
+		},
+		{
+			name: "unprompted replies only count against the chat",
+			calls: []call{
+				{1, 10, both, true, false, false},
+				{2, 0, both, true, false, false},
+				{2, 0, both, false, false, false},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewLimiter()
+			for i, c := range tt.calls {
+				allowed, userLimited, first := l.Allow(c.chatID, c.userID, c.rl)
+				if allowed != c.allowed || userLimited != c.userLimited || first != c.first {
+					t.Errorf("call %d: Allow(%d, %d) = %t, %t, %t, want %t, %t, %t", i,
+						c.chatID, c.userID, allowed, userLimited, first, c.allowed, c.userLimited, c.first)
+				}
+			}
+		})
+	}
+}
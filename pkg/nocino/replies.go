@@ -0,0 +1,107 @@
+package nocino
+
+import (
+	"sync"
+	"time"
+
+	"github.com/frapposelli/nocino/pkg/markov"
+)
+
+// maxReplies is the number of recent replies kept by Replies.
+const maxReplies = 1000
+
+// Reply is a message we sent, and how it was generated.
+type Reply struct {
+	ChatID    int64
+	MessageID int
+	// AskerID is the user whose message we replied to.
+	AskerID int
+	Trace   *markov.Trace
+	Sent    time.Time
+
+	// mutex serializes the votes on the reply.
+	mutex sync.Mutex
+	// votes maps the users who gave feedback on the reply to their vote.
+	votes map[int]vote
+}
+
+// vote is the feedback of a user on a reply, with what it changed in the
+// chain so it can be reverted exactly.
+type vote struct {
+	value   int
+	applied map[markov.Step]int
+}
+
+type replyKey struct {
+	chatID    int64
+	messageID int
+}
+
+// Replies keeps the most recent replies we sent, dropping the oldest ones
+// once full.
+type Replies struct {
+	mutex   sync.Mutex
+	replies map[replyKey]*Reply
+	order   []replyKey
+}
+
+func NewReplies() *Replies {
+	return &Replies{
+		replies: make(map[replyKey]*Reply),
+	}
+}
+
+// Add records a reply.
+func (r *Replies) Add(reply *Reply) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	k := replyKey{reply.ChatID, reply.MessageID}
+	if _, ok := r.replies[k]; !ok {
+		r.order = append(r.order, k)
+	}
+	r.replies[k] = reply
+	for len(r.order) > maxReplies {
+		delete(r.replies, r.order[0])
+		r.order = r.order[1:]
+	}
+}
+
+// Vote records the vote of userID on the reply with messageID in chatID, 1
+// for good and -1 for bad. Unless the vote is unchanged, apply is called with
+// what the vote it replaces changed in the chain, nil if none, and returns
+// what the new vote changes. Votes on a reply are applied one at a time. Vote
+// returns the replaced vote, 0 if none, and false if we don't remember the
+// reply.
+func (r *Replies) Vote(chatID int64, messageID int, userID int, value int, apply func(prev map[markov.Step]int) (map[markov.Step]int, error)) (int, bool, error) {
+	r.mutex.Lock()
+	reply, ok := r.replies[replyKey{chatID, messageID}]
+	r.mutex.Unlock()
+	if !ok {
+		return 0, false, nil
+	}
+
+	reply.mutex.Lock()
+	defer reply.mutex.Unlock()
+	prev := reply.votes[userID]
+	if prev.value == value {
+		return prev.value, true, nil
+	}
+	applied, err := apply(prev.applied)
+	if err != nil {
+		return prev.value, true, err
+	}
+	if reply.votes == nil {
+		reply.votes = make(map[int]vote)
+	}
+	reply.votes[userID] = vote{value: value, applied: applied}
+	return prev.value, true, nil
+}
+
+// Get returns the reply with messageID in chatID, or nil if we don't
+// remember it.
+func (r *Replies) Get(chatID int64, messageID int) *Reply {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.replies[replyKey{chatID, messageID}]
+}
@@ -0,0 +1,248 @@
+package nocino
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ChatSettings are the knobs of the bot that can be tuned for each chat.
+type ChatSettings struct {
+	// ReplyLength is the maximum number of words of generated replies.
+	ReplyLength int
+	// GIFRatio, StickerRatio and BothRatio are the shares of replies that
+	// are GIFs, stickers, or GIFs followed by text. The rest is text.
+	GIFRatio     float64
+	StickerRatio float64
+	BothRatio    float64
+	// Learning enables learning from the messages of the chat, LearnFilter
+	// picks which ones.
+	Learning     bool
+	LearnFilter  LearnFilter
+	Interjection Interjection
+	// Language is the language spoken in the chat, as an ISO 639-1 code,
+	// empty if unknown.
+	Language string
+	// ContentFilters are regular expressions matched case-insensitively:
+	// matching messages are not learned, and matching replies are not sent.
+	ContentFilters []string
+	// Aliases are names, besides its username, that summon the bot when
+	// they appear in a message as a whole word.
+	Aliases []string
+	// FeedbackUp and FeedbackDown are words that, in a reply to one of the
+	// bot messages, count as a vote for or against it.
+	FeedbackUp   []string
+	FeedbackDown []string
+	// QuietHours is a time of the day during which the bot does not talk.
+	QuietHours QuietHours
+	RateLimit  RateLimit
+}
+
+// LearnFilter configures which messages are not learned.
+type LearnFilter struct {
+	SkipBots     bool
+	SkipForwards bool
+	// SkipCommands skips messages starting with a command, which are usually
+	// meant for other bots.
+	SkipCommands bool
+	// MinLength and MaxLength bound the length of learned messages, in
+	// characters. 0 disables a bound.
+	MinLength int
+	MaxLength int
+	// MaxMarkup is the largest share of a message that can be URLs or code.
+	// 0 disables the check.
+	MaxMarkup float64
+}
+
+// filters caches the compiled content filters, nil for the ones that do not
+// compile.
+var filters = struct {
+	sync.RWMutex
+	re map[string]*regexp.Regexp
+}{re: make(map[string]*regexp.Regexp)}
+
+// Filtered returns true if text matches one of the content filters.
+// Filters that do not compile are ignored.
+func (s ChatSettings) Filtered(text string) bool {
+	for _, f := range s.ContentFilters {
+		filters.RLock()
+		re, ok := filters.re[f]
+		filters.RUnlock()
+		if !ok {
+			re, _ = regexp.Compile("(?i)" + f)
+			filters.Lock()
+			filters.re[f] = re
+			filters.Unlock()
+		}
+		if re != nil && re.MatchString(text) {
+			return true
+		}
+	}
+	return false
+}
+
+// Settings returns the settings of chatID. Settings the chat never changed
+// are taken from the defaults.
+func (n *Nocino) Settings(chatID int64) (ChatSettings, error) {
+	var overrides json.RawMessage
+	if _, err := n.Store.get("Settings", chatID, &overrides); err != nil {
+		return n.Defaults, err
+	}
+	s, err := n.mergeSettings(overrides)
+	if err != nil {
+		return n.Defaults, err
+	}
+	return s, nil
+}
+
+// SetSettings stores the settings of chatID that differ from the defaults,
+// or resets them all to the defaults if s is nil. The others keep following
+// the defaults when they change.
+func (n *Nocino) SetSettings(chatID int64, s *ChatSettings) error {
+	if s == nil {
+		return n.Store.delete("Settings", chatID)
+	}
+	settings, err := toJSONObject(s)
+	if err != nil {
+		return err
+	}
+	defaults, err := toJSONObject(n.Defaults)
+	if err != nil {
+		return err
+	}
+	overrides := diffJSON(settings, defaults)
+	if len(overrides) == 0 {
+		return n.Store.delete("Settings", chatID)
+	}
+	return n.Store.put("Settings", chatID, overrides)
+}
+
+// mergeSettings returns the defaults with overrides, a JSON object of the
+// settings a chat changed, applied over them.
+func (n *Nocino) mergeSettings(overrides json.RawMessage) (ChatSettings, error) {
+	var s ChatSettings
+	merged, err := toJSONObject(n.Defaults)
+	if err != nil {
+		return s, err
+	}
+	if len(overrides) > 0 {
+		o, err := decodeJSONObject(overrides)
+		if err != nil {
+			return s, err
+		}
+		mergeJSON(merged, o)
+	}
+	// decoding into a new value keeps the slices of the defaults untouched
+	buf, err := json.Marshal(merged)
+	if err != nil {
+		return s, err
+	}
+	err = json.Unmarshal(buf, &s)
+	return s, err
+}
+
+// toJSONObject returns v as a generic JSON object, keeping numbers as they
+// are written.
+func toJSONObject(v interface{}) (map[string]interface{}, error) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return decodeJSONObject(buf)
+}
+
+func decodeJSONObject(buf []byte) (map[string]interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+	var m map[string]interface{}
+	err := dec.Decode(&m)
+	return m, err
+}
+
+// diffJSON returns the fields of a that differ from the ones of b, going
+// down into nested objects.
+func diffJSON(a, b map[string]interface{}) map[string]interface{} {
+	diff := make(map[string]interface{})
+	for k, v := range a {
+		sub, ok := v.(map[string]interface{})
+		bsub, bok := b[k].(map[string]interface{})
+		switch {
+		case ok && bok:
+			if d := diffJSON(sub, bsub); len(d) > 0 {
+				diff[k] = d
+			}
+		case !reflect.DeepEqual(v, b[k]):
+			diff[k] = v
+		}
+	}
+	return diff
+}
+
+// mergeJSON sets the fields of o into m, going down into nested objects.
+func mergeJSON(m, o map[string]interface{}) {
+	for k, v := range o {
+		sub, ok := v.(map[string]interface{})
+		msub, mok := m[k].(map[string]interface{})
+		if ok && mok {
+			mergeJSON(msub, sub)
+			continue
+		}
+		m[k] = v
+	}
+}
+
+// QuietHours is a daily time range, in local time. The zero value is never
+// quiet.
+type QuietHours struct {
+	// Start and End are minutes since midnight. The range wraps around
+	// midnight if End is before Start.
+	Start int
+	End   int
+}
+
+// ParseQuietHours parses a time range written as HH:MM-HH:MM. An empty
+// string disables quiet hours.
+func ParseQuietHours(s string) (QuietHours, error) {
+	if s == "" {
+		return QuietHours{}, nil
+	}
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return QuietHours{}, fmt.Errorf("invalid quiet hours '%s', expected HH:MM-HH:MM", s)
+	}
+	var q QuietHours
+	for i, p := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(p))
+		if err != nil {
+			return QuietHours{}, fmt.Errorf("invalid quiet hours '%s', expected HH:MM-HH:MM", s)
+		}
+		m := t.Hour()*60 + t.Minute()
+		if i == 0 {
+			q.Start = m
+		} else {
+			q.End = m
+		}
+	}
+	return q, nil
+}
+
+// Contains returns true if t falls within the quiet hours.
+func (q QuietHours) Contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if q.Start <= q.End {
+		return m >= q.Start && m < q.End
+	}
+	return m >= q.Start || m < q.End
+}
+
+func (q QuietHours) String() string {
+	if q.Start == q.End {
+		return "none"
+	}
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", q.Start/60, q.Start%60, q.End/60, q.End%60)
+}
@@ -0,0 +1,145 @@
+package nocino
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// newTestNocino returns a Nocino with defaults over a temporary store, and a
+// function closing and removing it. It does not talk to Telegram.
+func newTestNocino(t *testing.T, defaults ChatSettings) (*Nocino, func()) {
+	dir, err := ioutil.TempDir("", "nocino-store-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	store, err := OpenStore(filepath.Join(dir, "bot.db"), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &Nocino{Store: store, Defaults: defaults}
+	return n, func() {
+		store.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSetSettingsStoresOverrides(t *testing.T) {
+	n, done := newTestNocino(t, ChatSettings{
+		ReplyLength:    25,
+		GIFRatio:       0.5,
+		Learning:       true,
+		ContentFilters: []string{"foo"},
+		RateLimit:      RateLimit{ChatRate: 20, ChatBurst: 10},
+	})
+	defer done()
+
+	s, err := n.Settings(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s, n.Defaults) {
+		t.Fatalf("settings of a new chat are %+v, want the defaults %+v", s, n.Defaults)
+	}
+	s.ContentFilters[0] = "bar"
+	if n.Defaults.ContentFilters[0] != "foo" {
+		t.Fatal("changing the settings of a chat changed the defaults")
+	}
+
+	s.ReplyLength = 10
+	s.RateLimit.UserRate = 2
+	s.ContentFilters = []string{"foo"}
+	if err := n.SetSettings(1, &s); err != nil {
+		t.Fatal(err)
+	}
+	var overrides json.RawMessage
+	if _, err := n.Store.get("Settings", 1, &overrides); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"ReplyLength": json.Number("10"),
+		"RateLimit":   map[string]interface{}{"UserRate": json.Number("2")},
+	}
+	if got, err := decodeJSONObject(overrides); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("stored overrides are %s, want %v", overrides, want)
+	}
+
+	// the settings not overridden follow the defaults
+	n.Defaults.GIFRatio = 0.2
+	n.Defaults.RateLimit.ChatRate = 5
+	s, err = n.Settings(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.ReplyLength != 10 || s.GIFRatio != 0.2 || s.RateLimit != (RateLimit{ChatRate: 5, ChatBurst: 10, UserRate: 2}) {
+		t.Errorf("settings are %+v, want the overrides over the new defaults", s)
+	}
+
+	// going back to the defaults stores nothing
+	s.ReplyLength = n.Defaults.ReplyLength
+	s.RateLimit = n.Defaults.RateLimit
+	if err := n.SetSettings(1, &s); err != nil {
+		t.Fatal(err)
+	}
+	if found, err := n.Store.get("Settings", 1, &overrides); err != nil || found {
+		t.Errorf("overrides stored after going back to the defaults: %s", overrides)
+	}
+
+	s.Learning = false
+	if err := n.SetSettings(1, &s); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.SetSettings(1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = n.Settings(1); err != nil || !reflect.DeepEqual(s, n.Defaults) {
+		t.Errorf("settings after reset are %+v, want the defaults %+v", s, n.Defaults)
+	}
+}
+
+func TestDiffMergeJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		diff string
+	}{
+		{"same", `{"x":1,"y":{"z":"a"}}`, `{"x":1,"y":{"z":"a"}}`, `{}`},
+		{"top level", `{"x":2,"y":{"z":"a"}}`, `{"x":1,"y":{"z":"a"}}`, `{"x":2}`},
+		{"nested", `{"x":1,"y":{"z":"b","w":true}}`, `{"x":1,"y":{"z":"a","w":true}}`, `{"y":{"z":"b"}}`},
+		{"list", `{"l":["a","b"]}`, `{"l":["a"]}`, `{"l":["a","b"]}`},
+		{"null list", `{"l":null}`, `{"l":["a"]}`, `{"l":null}`},
+		{"numbers as written", `{"f":0.1}`, `{"f":0.10}`, `{"f":0.1}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := decodeJSONObject([]byte(tt.a))
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := decodeJSONObject([]byte(tt.b))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := decodeJSONObject([]byte(tt.diff))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			diff := diffJSON(a, b)
+			if !reflect.DeepEqual(diff, want) {
+				t.Errorf("diff is %v, want %v", diff, want)
+			}
+			mergeJSON(b, diff)
+			if !reflect.DeepEqual(b, a) {
+				t.Errorf("merging the diff gives %v, want %v", b, a)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package nocino
+
+import (
+	"math/rand"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// AddSticker records a sticker seen in a chat, so it can be sent back.
+func (s *Store) AddSticker(fileID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("Stickers")).Put([]byte(fileID), []byte{})
+	})
+}
+
+// HasStickers returns true if any sticker was recorded.
+func (s *Store) HasStickers() bool {
+	var found bool
+	s.db.View(func(tx *bolt.Tx) error {
+		k, _ := tx.Bucket([]byte("Stickers")).Cursor().First()
+		found = k != nil
+		return nil
+	})
+	return found
+}
+
+// Stickers returns the number of stickers recorded. It walks all of them.
+func (s *Store) Stickers() int {
+	var n int
+	s.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket([]byte("Stickers")).Stats().KeyN
+		return nil
+	})
+	return n
+}
+
+// RandomSticker returns the file ID of a sticker picked with r, or an empty
+// string if there are none.
+func (s *Store) RandomSticker(r *rand.Rand) (string, error) {
+	var fileID string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		// reservoir sampling, to walk the stickers once
+		var n int
+		c := tx.Bucket([]byte("Stickers")).Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			n++
+			if r.Intn(n) == 0 {
+				fileID = string(k)
+			}
+		}
+		return nil
+	})
+	return fileID, err
+}
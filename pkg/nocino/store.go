@@ -0,0 +1,87 @@
+package nocino
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// storeBuckets are the buckets of the bot state DB. Most are keyed by chat
+// ID, Stickers is keyed by file ID and OptOut by user ID.
+var storeBuckets = []string{"Settings", "Triggers", "Inactive", "Stickers", "OptOut", "Blocklist", "Feedback"}
+
+// Store keeps per-chat configuration in a bolt DB. It is separate from the
+// chain state so restoring a chain backup does not undo it.
+type Store struct {
+	db  *bolt.DB
+	log *logrus.Entry
+}
+
+// OpenStore opens the bot state DB at path, creating it if needed.
+func OpenStore(path string, logger *logrus.Logger) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range storeBuckets {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{
+		db:  db,
+		log: logger.WithField("component", "store"),
+	}, nil
+}
+
+// Close closes the DB.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// get unmarshals the value stored for chatID in bucket into v. It returns
+// false if there is none.
+func (s *Store) get(bucket string, chatID int64, v interface{}) (bool, error) {
+	var found bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		buf := tx.Bucket([]byte(bucket)).Get(chatKey(chatID))
+		if buf == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(buf, v)
+	})
+	return found, err
+}
+
+// put stores v for chatID in bucket.
+func (s *Store) put(bucket string, chatID int64, v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucket)).Put(chatKey(chatID), buf)
+	})
+}
+
+// delete removes the value stored for chatID in bucket.
+func (s *Store) delete(bucket string, chatID int64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucket)).Delete(chatKey(chatID))
+	})
+}
+
+func chatKey(chatID int64) []byte {
+	return []byte(strconv.FormatInt(chatID, 10))
+}
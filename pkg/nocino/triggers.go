@@ -0,0 +1,98 @@
+package nocino
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// wordStart and wordEnd match the edges of a word. RE2's \b only knows
+// ASCII letters, so it would not match after "però".
+const (
+	wordStart = `(?:^|[^\p{L}\p{N}_])`
+	wordEnd   = `(?:$|[^\p{L}\p{N}_])`
+)
+
+// maxTriggers is the number of triggers a chat can have.
+const maxTriggers = 50
+
+// ErrTooManyTriggers is returned when a chat would have more than
+// maxTriggers triggers.
+var ErrTooManyTriggers = fmt.Errorf("a chat can have at most %d triggers", maxTriggers)
+
+// Trigger is a word or regular expression that summons the bot when a
+// message in the chat matches it.
+type Trigger struct {
+	// Pattern is a word, matched case-insensitively as a whole word, or a
+	// regular expression if Regex is set.
+	Pattern string
+	Regex   bool
+	// Probability of answering a matching message.
+	Probability float64
+	// Reply is sent instead of generated text, if set.
+	Reply string
+	re    *regexp.Regexp
+}
+
+// Compile returns the regular expression matching the trigger.
+func (t Trigger) Compile() (*regexp.Regexp, error) {
+	if t.Regex {
+		return regexp.Compile(t.Pattern)
+	}
+	return regexp.Compile(`(?i)` + wordStart + regexp.QuoteMeta(t.Pattern) + wordEnd)
+}
+
+// Match returns true if text matches the trigger. Triggers that do not
+// compile never match.
+func (t Trigger) Match(text string) bool {
+	re := t.re
+	if re == nil {
+		var err error
+		if re, err = t.Compile(); err != nil {
+			return false
+		}
+	}
+	return re.MatchString(text)
+}
+
+// Triggers returns the triggers of chatID, compiled. They are cached until
+// changed with SetTriggers.
+func (n *Nocino) Triggers(chatID int64) ([]Trigger, error) {
+	n.triggersMutex.RLock()
+	triggers, ok := n.triggers[chatID]
+	gen := n.triggersGen
+	n.triggersMutex.RUnlock()
+	if !ok {
+		if _, err := n.Store.get("Triggers", chatID, &triggers); err != nil {
+			return nil, err
+		}
+		for i := range triggers {
+			triggers[i].re, _ = triggers[i].Compile()
+		}
+		n.triggersMutex.Lock()
+		// unless SetTriggers ran meanwhile, and what we read may be stale
+		if n.triggersGen == gen {
+			n.triggers[chatID] = triggers
+		}
+		n.triggersMutex.Unlock()
+	}
+	// callers may change the slice they get
+	return append([]Trigger(nil), triggers...), nil
+}
+
+// SetTriggers replaces the triggers of chatID.
+func (n *Nocino) SetTriggers(chatID int64, triggers []Trigger) error {
+	if len(triggers) > maxTriggers {
+		return ErrTooManyTriggers
+	}
+	var err error
+	if len(triggers) == 0 {
+		err = n.Store.delete("Triggers", chatID)
+	} else {
+		err = n.Store.put("Triggers", chatID, triggers)
+	}
+	n.triggersMutex.Lock()
+	delete(n.triggers, chatID)
+	n.triggersGen++
+	n.triggersMutex.Unlock()
+	return err
+}